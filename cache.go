@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package setdb
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/poolpOrg/go-setdb/sets"
+)
+
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	Capacity  int    `json:"capacity"`
+}
+
+type cacheEntry struct {
+	name         string
+	items        *sets.Set
+	dependencies []string
+}
+
+// cache keeps the evaluated content of named sets, least recently used
+// entries are evicted once capacity is reached. An entry is invalidated
+// whenever the set or one of the sets it depends on is persisted, which
+// only covers writes going through the same Database.
+type cache struct {
+	mu       sync.Mutex
+	capacity int
+	lru      *list.List
+	entries  map[string]*list.Element
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func newCache(capacity int) *cache {
+	return &cache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *cache) get(name string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.entries[name]
+	if !exists {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(element)
+	return element.Value.(*cacheEntry), true
+}
+
+// peek returns the entry for name without accounting for it in statistics
+// nor refreshing its position.
+func (c *cache) peek(name string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.entries[name]
+	if !exists {
+		return nil, false
+	}
+	return element.Value.(*cacheEntry), true
+}
+
+func (c *cache) put(name string, items *sets.Set, dependencies []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{
+		name:         name,
+		items:        items,
+		dependencies: dependencies,
+	}
+	if element, exists := c.entries[name]; exists {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[name] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).name)
+		c.evictions++
+	}
+}
+
+// invalidate drops the entry for name along with the entries of every set
+// depending on it, directly or through a wildcard, dependencies being
+// transitive this covers them all.
+func (c *cache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*cacheEntry)
+		if entry.name == name || covers(entry.dependencies, name) {
+			c.lru.Remove(element)
+			delete(c.entries, entry.name)
+		}
+		element = next
+	}
+}
+
+func (c *cache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   c.lru.Len(),
+		Capacity:  c.capacity,
+	}
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// EnableCache materializes the content of up to capacity named sets as they
+// are evaluated, a capacity of 0 disables the cache.
+func (db *Database) EnableCache(capacity int) {
+	if capacity <= 0 {
+		db.cache = nil
+		return
+	}
+	db.cache = newCache(capacity)
+}
+
+func (db *Database) CacheStats() CacheStats {
+	if db.cache == nil {
+		return CacheStats{}
+	}
+	return db.cache.stats()
+}
+
+func (db *Database) invalidate(name string) {
+	db.filters.invalidate(name)
+	if db.cache != nil {
+		db.cache.invalidate(name)
+	}
+}
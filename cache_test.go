@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package setdb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/poolpOrg/go-setdb/sets"
+)
+
+// cached returns the names of the entries of a cache, sorted.
+func cached(c *cache) string {
+	names := make([]string, 0, len(c.entries))
+	for name := range c.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	// dependencies are recorded transitively: c references b which
+	// references a, w references the sets matching team:*
+	entries := []struct {
+		name         string
+		dependencies []string
+	}{
+		{"a", nil},
+		{"b", []string{"a"}},
+		{"c", []string{"a", "b"}},
+		{"d", nil},
+		{"team:1", nil},
+		{"w", []string{"team:*", "team:1"}},
+		{"v", []string{"team:*", "team:1", "w"}},
+	}
+
+	tests := []struct {
+		invalidated []string
+		want        string
+	}{
+		{nil, "a b c d team:1 v w"},
+		{[]string{"d"}, "a b c team:1 v w"},
+		{[]string{"c"}, "a b d team:1 v w"},
+		{[]string{"b"}, "a d team:1 v w"},
+		{[]string{"a"}, "d team:1 v w"},
+		{[]string{"w"}, "a b c d team:1"},
+		{[]string{"team:1"}, "a b c d"},
+		// a set created or dropped under a wildcard
+		{[]string{"team:2"}, "a b c d team:1"},
+		{[]string{"nope"}, "a b c d team:1 v w"},
+		// a renamed set is invalidated under both names
+		{[]string{"a", "z"}, "d team:1 v w"},
+		{[]string{"d", "team:3"}, "a b c team:1"},
+	}
+
+	for _, test := range tests {
+		c := newCache(len(entries))
+		for _, entry := range entries {
+			c.put(entry.name, sets.NewSet(), entry.dependencies)
+		}
+		for _, name := range test.invalidated {
+			c.invalidate(name)
+		}
+		if got := cached(c); got != test.want {
+			t.Errorf("invalidate %v: cached [%s], want [%s]", test.invalidated, got, test.want)
+		}
+		if stats := c.stats(); stats.Entries != c.lru.Len() || c.lru.Len() != len(c.entries) {
+			t.Errorf("invalidate %v: %d entries, %d in the list", test.invalidated, len(c.entries), c.lru.Len())
+		}
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	c := newCache(2)
+	c.put("a", sets.NewSet(), nil)
+
+	for _, name := range []string{"a", "a", "b"} {
+		c.get(name)
+	}
+	// peeking is not accounted for
+	c.peek("a")
+	c.peek("b")
+
+	want := CacheStats{Hits: 2, Misses: 1, Entries: 1, Capacity: 2}
+	if got := c.stats(); got != want {
+		t.Errorf("stats %+v, want %+v", got, want)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	const capacity = 4
+	c := newCache(capacity)
+
+	for i := 0; i < 3*capacity; i++ {
+		c.put(fmt.Sprintf("s%d", i), sets.NewSet(), nil)
+		// s0 is used after every insertion, it is never the least
+		// recently used entry
+		if _, exists := c.get("s0"); !exists {
+			t.Fatalf("s0 evicted after s%d", i)
+		}
+		if c.lru.Len() > capacity || len(c.entries) > capacity {
+			t.Fatalf("%d entries, capacity %d", len(c.entries), capacity)
+		}
+	}
+	if got, want := cached(c), "s0 s10 s11 s9"; got != want {
+		t.Errorf("cached [%s], want [%s]", got, want)
+	}
+
+	// replacing an entry doesn't evict another one
+	c.put("s9", sets.NewSet(), nil)
+	if stats := c.stats(); stats.Evictions != 3*capacity-capacity || stats.Entries != capacity {
+		t.Errorf("stats %+v, want %d evictions, %d entries", stats, 3*capacity-capacity, capacity)
+	}
+}
@@ -25,8 +25,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/poolpOrg/go-setdb"
+	"github.com/poolpOrg/go-setdb/sets"
+	_ "github.com/poolpOrg/go-setdb/storage/memory"
 	_ "github.com/poolpOrg/go-setdb/storage/sqlite"
 )
 
@@ -34,13 +38,114 @@ type Query struct {
 	Expression string `json:"expression"`
 }
 
+func printResult(set *setdb.Set) {
+	switch set.Type() {
+	case setdb.BooleanResult:
+		fmt.Println(set.Boolean())
+	case setdb.ScalarResult:
+		fmt.Println(strconv.FormatFloat(set.Scalar(), 'f', -1, 64))
+	case setdb.PlanResult:
+		printPlan(set.Plan(), 0)
+	default:
+		printItems(set)
+	}
+}
+
+// printItems prints the items of a set as they are iterated, in the same
+// format as a slice.
+func printItems(set *setdb.Set) {
+	it := set.Iterator()
+	defer it.Close()
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	w.WriteString("[")
+	for i := 0; ; i++ {
+		item, ok := it.Next()
+		if !ok {
+			break
+		}
+		if i != 0 {
+			w.WriteString(" ")
+		}
+		w.WriteString(item.String())
+	}
+	w.WriteString("]\n")
+}
+
+func printPlan(plan *setdb.Plan, depth int) {
+	indent := strings.Repeat("  ", depth)
+
+	result := "not evaluated"
+	if plan.Evaluated {
+		if plan.Boolean != nil {
+			result = fmt.Sprintf("%t in %s", *plan.Boolean, plan.Duration)
+		} else if plan.Scalar != nil {
+			result = fmt.Sprintf("%s in %s", strconv.FormatFloat(*plan.Scalar, 'f', -1, 64), plan.Duration)
+		} else {
+			result = fmt.Sprintf("%d items in %s", plan.Cardinality, plan.Duration)
+		}
+	}
+	fmt.Printf("%s%s: %s, %s\n", indent, plan.Query, plan.Node, result)
+
+	if plan.Pattern != "" {
+		fmt.Printf("%s  pattern: %s\n", indent, plan.Pattern)
+		if len(plan.DependsOn) != 0 {
+			fmt.Printf("%s  depends on: %s\n", indent, strings.Join(plan.DependsOn, ", "))
+		}
+	}
+	for _, child := range plan.Children {
+		printPlan(child, depth+1)
+	}
+}
+
+// printResponse prints the result of a query sent to a server, plans being
+// the only results encoded as JSON objects and scalars as JSON numbers.
+func printResponse(body []byte) {
+	var result interface{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		fmt.Fprintf(os.Stderr, "ERR: %s\n", err)
+		return
+	}
+	if scalar, ok := result.(float64); ok {
+		fmt.Println(strconv.FormatFloat(scalar, 'f', -1, 64))
+		return
+	}
+	if _, ok := result.(map[string]interface{}); ok {
+		var plan setdb.Plan
+		if err := json.Unmarshal(body, &plan); err != nil {
+			fmt.Fprintf(os.Stderr, "ERR: %s\n", err)
+			return
+		}
+		printPlan(&plan, 0)
+		return
+	}
+	if _, ok := result.([]interface{}); ok {
+		var items []sets.Item
+		if err := json.Unmarshal(body, &items); err != nil {
+			fmt.Fprintf(os.Stderr, "ERR: %s\n", err)
+			return
+		}
+		fmt.Println(items)
+		return
+	}
+	fmt.Println(result)
+}
+
 func main() {
+	var backendName string
 	var databaseName string
 	var serverURL string
 	var useStdin bool
+	var reindex bool
+	var migrateBooleans bool
 
 	flag.StringVar(&serverURL, "server", "", "server URL")
+	flag.StringVar(&backendName, "backend", "sqlite", fmt.Sprintf("storage backend (%s)", strings.Join(setdb.Backends(), ", ")))
 	flag.StringVar(&databaseName, "database", "default", "database name")
+	flag.BoolVar(&reindex, "reindex", false, "re-evaluate and re-persist every set before running queries")
+	flag.BoolVar(&migrateBooleans, "migrate-booleans", false, "quote references to sets named true or false persisted before booleans, once, before running queries")
 	flag.Parse()
 
 	if flag.NArg() < 1 {
@@ -50,19 +155,34 @@ func main() {
 	}
 
 	if serverURL == "" {
-		db, err := setdb.Open("sqlite", databaseName)
+		db, err := setdb.Open(backendName, databaseName)
 		if err != nil {
-			panic(err)
+			fmt.Fprintf(os.Stderr, "ERR: %s\n", err)
+			os.Exit(1)
 		}
 		defer db.Close()
 
+		if migrateBooleans {
+			if err := db.MigrateBooleans(); err != nil {
+				fmt.Fprintf(os.Stderr, "ERR: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
+		if reindex {
+			if err := db.Reindex(); err != nil {
+				fmt.Fprintf(os.Stderr, "ERR: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
 		if !useStdin {
 			expression := flag.Arg(0)
 			set, err := db.Query(expression)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "ERR: %s\n", err)
 			} else {
-				fmt.Println(set.Items())
+				printResult(set)
 			}
 		} else {
 			fmt.Printf("setdb> ")
@@ -75,7 +195,7 @@ func main() {
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "ERR: %s\n", err)
 				} else {
-					fmt.Println(set.Items())
+					printResult(set)
 				}
 				fmt.Printf("setdb> ")
 			}
@@ -108,13 +228,7 @@ func main() {
 
 			}
 
-			var result []string
-			err = json.Unmarshal(body, &result)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "ERR: %s\n", err)
-			} else {
-				fmt.Println(result)
-			}
+			printResponse(body)
 		} else {
 			fmt.Printf("setdb> ")
 			scanner := bufio.NewScanner(os.Stdin)
@@ -140,13 +254,7 @@ func main() {
 					fmt.Fprintf(os.Stderr, "ERR: %s\n", err)
 
 				}
-				var result []string
-				err = json.Unmarshal(body, &result)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "ERR: %s\n", err)
-				} else {
-					fmt.Println(result)
-				}
+				printResponse(body)
 				fmt.Printf("setdb> ")
 			}
 
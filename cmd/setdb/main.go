@@ -17,16 +17,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"sync"
 
 	"github.com/gorilla/mux"
 	"github.com/poolpOrg/go-setdb"
-	_ "github.com/poolpOrg/go-setdb/storage/sqlite"
+	"github.com/poolpOrg/go-setdb/sets"
+	"github.com/poolpOrg/go-setdb/storage/sqlite"
 )
 
+var databaseDir string
+var cacheCapacity int
+
 var globalDatabasesMutex = sync.Mutex{}
 var database = make(map[string]*setdb.Database)
 var databaseMutex = make(map[string]*sync.Mutex)
@@ -35,17 +46,20 @@ func openDatabase(name string) (*setdb.Database, error) {
 	globalDatabasesMutex.Lock()
 	defer globalDatabasesMutex.Unlock()
 
-	if conn, exists := database[name]; exists {
-		databaseMutex[name].Lock()
+	// connections are keyed by DSN as this is what Database.Name() returns
+	dsn := sqlite.Options{Name: name, Dir: databaseDir}.DSN()
+	if conn, exists := database[dsn]; exists {
+		databaseMutex[dsn].Lock()
 		return conn, nil
 	} else {
-		conn, err := setdb.Open("sqlite", name)
+		conn, err := setdb.Open("sqlite", dsn)
 		if err != nil {
 			return nil, err
 		}
-		database[name] = conn
-		databaseMutex[name] = &sync.Mutex{}
-		databaseMutex[name].Lock()
+		conn.EnableCache(cacheCapacity)
+		database[dsn] = conn
+		databaseMutex[dsn] = &sync.Mutex{}
+		databaseMutex[dsn].Lock()
 		return conn, nil
 	}
 }
@@ -78,8 +92,172 @@ func getDatabaseHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(&sets)
 }
 
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, setdb.ErrSetNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, setdb.ErrSetExists),
+		errors.Is(err, setdb.ErrSetReferenced),
+		errors.Is(err, setdb.ErrCyclicReference):
+		return http.StatusConflict
+	case errors.Is(err, setdb.ErrSyntax),
+		errors.Is(err, setdb.ErrTypeMismatch),
+		errors.Is(err, setdb.ErrInvalidOperand):
+		return http.StatusBadRequest
+	default:
+		// stored patterns failing to parse and backend failures are not
+		// the client's fault
+		return http.StatusInternalServerError
+	}
+}
+
+func getDatabaseCacheHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	dbname := vars["dbname"]
+
+	db, err := openDatabase(dbname)
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	defer closeDatabase(db)
+
+	stats := db.CacheStats()
+	json.NewEncoder(w).Encode(&stats)
+}
+
+// Query is the body of a query request. Items of a set are streamed, a
+// page of them being selected with offset and limit, and the page token
+// returned along a page in the X-Next-Page-Token header resumes after it
+// even if the set changed meanwhile.
 type Query struct {
 	Expression string `json:"expression"`
+	Offset     int64  `json:"offset,omitempty"`
+	Limit      int64  `json:"limit,omitempty"`
+	PageToken  string `json:"page_token,omitempty"`
+}
+
+func encodePageToken(item sets.Item) (string, error) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodePageToken(token string) (sets.Item, error) {
+	var item sets.Item
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return item, fmt.Errorf("invalid page token: %s", token)
+	}
+	if err := json.Unmarshal(data, &item); err != nil {
+		return item, fmt.Errorf("invalid page token: %s", token)
+	}
+	return item, nil
+}
+
+// openPage returns an iterator positioned at the first item of the page, a
+// page token is sought rather than walked to. The set has been evaluated in
+// full by then, paging doesn't spare that.
+func openPage(set *setdb.Set, q *Query) (*sets.Iterator, error) {
+	it := set.Iterator()
+	if q.PageToken != "" {
+		last, err := decodePageToken(q.PageToken)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.Seek(last)
+		if next, ok := it.Next(); ok && next != last {
+			it.Seek(next)
+		}
+	}
+	it.Skip(q.Offset)
+	return it, nil
+}
+
+// writePage encodes the items of a page either as a JSON array or as
+// newline delimited JSON, it returns the last item written and whether
+// items remain past the page.
+func writePage(out io.Writer, it *sets.Iterator, limit int64, ndjson bool) (sets.Item, bool, error) {
+	var last sets.Item
+	if !ndjson {
+		io.WriteString(out, "[")
+	}
+	for count := int64(0); limit == 0 || count < limit; count++ {
+		item, ok := it.Next()
+		if !ok {
+			break
+		}
+		data, err := json.Marshal(item)
+		if err != nil {
+			return last, false, err
+		}
+		if !ndjson && count != 0 {
+			io.WriteString(out, ",")
+		}
+		out.Write(data)
+		if ndjson {
+			io.WriteString(out, "\n")
+		}
+		last = item
+	}
+	if !ndjson {
+		io.WriteString(out, "]\n")
+	}
+
+	if limit == 0 {
+		return last, false, nil
+	}
+	_, more := it.Next()
+	return last, more, nil
+}
+
+// writeItems streams a page of items, see writePage. The token of the next
+// page is only known once the page has been walked, so a page is encoded
+// before being written while a whole set is streamed as it is walked.
+func writeItems(w http.ResponseWriter, r *http.Request, set *setdb.Set, q *Query) {
+	if q.Offset < 0 || q.Limit < 0 {
+		w.WriteHeader(400)
+		w.Write([]byte("offset and limit must be positive"))
+		return
+	}
+
+	it, err := openPage(set, q)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer it.Close()
+
+	ndjson := strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+
+	if q.Limit == 0 {
+		buf := bufio.NewWriter(w)
+		defer buf.Flush()
+		writePage(buf, it, 0, ndjson)
+		return
+	}
+
+	var page bytes.Buffer
+	last, more, err := writePage(&page, it, q.Limit, ndjson)
+	if err == nil && more {
+		var token string
+		token, err = encodePageToken(last)
+		w.Header().Set("X-Next-Page-Token", token)
+	}
+	if err != nil {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(page.Bytes())
 }
 
 func postDatabaseQueryHandler(w http.ResponseWriter, r *http.Request) {
@@ -104,26 +282,35 @@ func postDatabaseQueryHandler(w http.ResponseWriter, r *http.Request) {
 
 	set, err := db.Query(q.Expression)
 	if err != nil {
-		w.WriteHeader(400)
+		w.WriteHeader(errorStatus(err))
 		w.Write([]byte(err.Error()))
 		return
 	}
-	items := set.Items()
-	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte(err.Error()))
+	switch set.Type() {
+	case setdb.BooleanResult:
+		json.NewEncoder(w).Encode(set.Boolean())
+		return
+	case setdb.ScalarResult:
+		json.NewEncoder(w).Encode(set.Scalar())
+		return
+	case setdb.PlanResult:
+		json.NewEncoder(w).Encode(set.Plan())
 		return
 	}
 
-	json.NewEncoder(w).Encode(items)
+	writeItems(w, r, set, &q)
 }
 
 func main() {
+	flag.StringVar(&databaseDir, "dir", "", "directory holding the databases (default /tmp)")
+	flag.IntVar(&cacheCapacity, "cache", 0, "number of evaluated sets cached per database (0 disables)")
+	flag.Parse()
 
 	r := mux.NewRouter()
 
 	r.HandleFunc("/database/{dbname}", getDatabaseHandler).Methods("GET")
 	r.HandleFunc("/database/{dbname}", postDatabaseQueryHandler).Methods("POST")
+	r.HandleFunc("/database/{dbname}/cache", getDatabaseCacheHandler).Methods("GET")
 
 	http.ListenAndServe("0.0.0.0:3031", r)
 }
@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/poolpOrg/go-setdb"
+	"github.com/poolpOrg/go-setdb/query/lexer"
+	"github.com/poolpOrg/go-setdb/query/parser"
+	_ "github.com/poolpOrg/go-setdb/storage/memory"
+)
+
+func TestErrorStatus(t *testing.T) {
+	_, syntaxErr := parser.NewParser(lexer.NewLexer(strings.NewReader("a |"))).Parse()
+	if syntaxErr == nil {
+		t.Fatal("expected a syntax error")
+	}
+
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{syntaxErr, http.StatusBadRequest},
+		{fmt.Errorf("%w: a: %s", setdb.ErrInvalidPattern, syntaxErr), http.StatusInternalServerError},
+		{fmt.Errorf("%w: a", setdb.ErrSetNotFound), http.StatusNotFound},
+		{fmt.Errorf("%w: a", setdb.ErrSetExists), http.StatusConflict},
+		{fmt.Errorf("%w: a", setdb.ErrSetReferenced), http.StatusConflict},
+		{fmt.Errorf("%w: a", setdb.ErrCyclicReference), http.StatusConflict},
+		{fmt.Errorf("%w: 'x' is not of type integer", setdb.ErrTypeMismatch), http.StatusBadRequest},
+		{fmt.Errorf("%w: range is too large", setdb.ErrInvalidOperand), http.StatusBadRequest},
+		// anything else is not the client's fault
+		{errors.New("database is locked"), http.StatusInternalServerError},
+		{fmt.Errorf("%w: a", setdb.ErrBackendNotFound), http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		if status := errorStatus(test.err); status != test.status {
+			t.Errorf("errorStatus(%q) = %d, want %d", test.err, status, test.status)
+		}
+	}
+}
+
+func TestQueryErrorStatus(t *testing.T) {
+	db, err := setdb.Open("memory", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	queries := []string{"a = {1, 2} AS integer", "b = a | {'x'}"}
+	for i := 0; i < 8; i++ {
+		queries = append(queries, fmt.Sprintf("x:%d = {%d}", i, i))
+	}
+	for _, query := range queries {
+		if _, err := db.Query(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"a |", http.StatusBadRequest},
+		{"{'a'..'zz'}", http.StatusBadRequest},
+		{"{i in a | i =~ '['}", http.StatusBadRequest},
+		{"a += {'x'}", http.StatusBadRequest},
+		{"sum(b)", http.StatusBadRequest},
+		{"min({})", http.StatusBadRequest},
+		{"{1..10000000000}", http.StatusBadRequest},
+		{"approx_count(a | x:*)", http.StatusBadRequest},
+		{"nope", http.StatusNotFound},
+		{"a = b", http.StatusConflict},
+		{"DROP a", http.StatusConflict},
+		{"RENAME b TO a", http.StatusConflict},
+	}
+	for _, test := range tests {
+		_, err := db.Query(test.query)
+		if err == nil {
+			t.Errorf("%s: succeeded", test.query)
+			continue
+		}
+		if status := errorStatus(err); status != test.status {
+			t.Errorf("%s: %v: status %d, want %d", test.query, err, status, test.status)
+		}
+	}
+}
+
+func TestWriteItems(t *testing.T) {
+	db, err := setdb.Open("memory", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	set, err := db.Query("{1..5, 'a'}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query  Query
+		ndjson bool
+		body   string
+		next   bool
+	}{
+		{Query{}, false, "[1,2,3,4,5,\"a\"]\n", false},
+		{Query{}, true, "1\n2\n3\n4\n5\n\"a\"\n", false},
+		{Query{Limit: 2}, false, "[1,2]\n", true},
+		{Query{Limit: 2}, true, "1\n2\n", true},
+		{Query{Offset: 4, Limit: 2}, false, "[5,\"a\"]\n", false},
+		{Query{Offset: 3, Limit: 2}, false, "[4,5]\n", true},
+		{Query{Offset: 6, Limit: 2}, false, "[]\n", false},
+		{Query{Limit: 6}, false, "[1,2,3,4,5,\"a\"]\n", false},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/database/test", nil)
+		if test.ndjson {
+			r.Header.Set("Accept", "application/x-ndjson")
+		}
+		writeItems(w, r, set, &test.query)
+		if w.Code != http.StatusOK {
+			t.Errorf("%+v: status %d", test.query, w.Code)
+		}
+		if body := w.Body.String(); body != test.body {
+			t.Errorf("%+v: got %q, want %q", test.query, body, test.body)
+		}
+		if token := w.Header().Get("X-Next-Page-Token"); (token != "") != test.next {
+			t.Errorf("%+v: next page token %q", test.query, token)
+		}
+	}
+
+	// walking pages with their token yields every item once
+	var pages []string
+	q := Query{Limit: 2}
+	for {
+		w := httptest.NewRecorder()
+		writeItems(w, httptest.NewRequest("POST", "/database/test", nil), set, &q)
+		pages = append(pages, strings.TrimSpace(w.Body.String()))
+		q.PageToken = w.Header().Get("X-Next-Page-Token")
+		if q.PageToken == "" {
+			break
+		}
+	}
+	if got := strings.Join(pages, " "); got != "[1,2] [3,4] [5,\"a\"]" {
+		t.Errorf("pages: got %s", got)
+	}
+}
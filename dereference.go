@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package setdb
+
+import "github.com/poolpOrg/go-setdb/query/ast"
+
+// dereference replaces every dereference node in a statement with an inline
+// set holding the items its expression evaluates to right now, so that the
+// persisted pattern is a snapshot and no longer tracks the dereferenced sets.
+func (db *Database) dereference(statement ast.Statement) (ast.Statement, error) {
+	switch node := statement.(type) {
+	case *ast.Dereference:
+		return db.snapshot(node.Expr)
+
+	case *ast.BinaryExpr:
+		lhs, err := db.dereference(node.LHS)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := db.dereference(node.RHS)
+		if err != nil {
+			return nil, err
+		}
+		node.LHS = lhs.(ast.Node)
+		node.RHS = rhs.(ast.Node)
+		return node, nil
+
+	case *ast.Comprehension:
+		source, err := db.dereference(node.Source)
+		if err != nil {
+			return nil, err
+		}
+		node.Source = source.(ast.Node)
+		return node, nil
+
+	case *ast.TypeAssertion:
+		expr, err := db.dereference(node.Expr)
+		if err != nil {
+			return nil, err
+		}
+		node.Expr = expr.(ast.Node)
+		return node, nil
+
+	case *ast.ComparisonExpr:
+		lhs, err := db.dereference(node.LHS)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := db.dereference(node.RHS)
+		if err != nil {
+			return nil, err
+		}
+		node.LHS = lhs.(ast.Node)
+		node.RHS = rhs.(ast.Node)
+		return node, nil
+
+	case *ast.Set:
+		nodes := make([]ast.Node, 0, len(node.Node))
+		for _, item := range node.Node {
+			expr, err := db.dereference(item)
+			if err != nil {
+				return nil, err
+			}
+			// a dereference within an inline set contributes its items
+			// directly rather than a nested inline set
+			if _, ok := item.(*ast.Dereference); ok {
+				nodes = append(nodes, expr.(*ast.Set).Node...)
+			} else {
+				nodes = append(nodes, expr.(ast.Node))
+			}
+		}
+		node.Node = nodes
+		return node, nil
+
+	default:
+		return statement, nil
+	}
+}
+
+func (db *Database) snapshot(node ast.Node) (*ast.Set, error) {
+	// a snapshot does not depend on the sets it reads from, so it is not
+	// evaluated on behalf of a set and the traversed sets are discarded
+	setResolver := db.newResolver("")
+
+	resultset, err := node.Evaluate(setResolver.resolve)
+	if err != nil {
+		return nil, err
+	}
+
+	items := resultset.ItemsList()
+
+	nodes := make([]ast.Node, 0, len(items))
+	for _, item := range items {
+		nodes = append(nodes, &ast.Item{Value: item})
+	}
+	return &ast.Set{Node: nodes}, nil
+}
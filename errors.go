@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package setdb
+
+import (
+	"errors"
+
+	"github.com/poolpOrg/go-setdb/query/ast"
+	"github.com/poolpOrg/go-setdb/query/parser"
+)
+
+// Errors returned by Database methods and backends are wrapped around these
+// so that callers can tell them apart with errors.Is.
+var (
+	ErrBackendNotFound = errors.New("backend does not exist")
+	ErrSetNotFound     = errors.New("set does not exist")
+	ErrSetExists       = errors.New("set already exists")
+	ErrSetReferenced   = errors.New("set is referenced")
+	ErrCyclicReference = errors.New("cyclic reference is forbidden")
+
+	// ErrInvalidPattern is returned when the pattern persisted for a set
+	// can't be parsed back, it never wraps ErrSyntax.
+	ErrInvalidPattern = errors.New("invalid pattern")
+
+	// ErrSyntax wraps every parser.ParserError, use errors.As to access
+	// the position of the error.
+	ErrSyntax = parser.ErrSyntax
+
+	// ErrTypeMismatch is returned when a set declared with AS would hold
+	// an item of another type, be it assigned or refreshed by a write to
+	// a set it references.
+	ErrTypeMismatch = ast.ErrTypeMismatch
+
+	// ErrInvalidOperand is returned when a query can't be evaluated as
+	// written, such as when enumerating a range too large.
+	ErrInvalidOperand = ast.ErrInvalidOperand
+)
@@ -0,0 +1,375 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package setdb
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/poolpOrg/go-setdb/query/ast"
+	"github.com/poolpOrg/go-setdb/query/lexer"
+	"github.com/poolpOrg/go-setdb/query/optimizer"
+	"github.com/poolpOrg/go-setdb/query/parser"
+	"github.com/poolpOrg/go-setdb/sets"
+)
+
+// Plan describes the evaluation of a node of a query. Named sets are
+// expanded with their stored pattern, the sets they depend on and the plan
+// of their pattern, so that the tree covers everything that was evaluated.
+type Plan struct {
+	Node        string        `json:"node"`
+	Query       string        `json:"query"`
+	Name        string        `json:"name,omitempty"`
+	Pattern     string        `json:"pattern,omitempty"`
+	DependsOn   []string      `json:"dependsOn,omitempty"`
+	Evaluated   bool          `json:"evaluated"`
+	Cardinality int64         `json:"cardinality"`
+	Boolean     *bool         `json:"boolean,omitempty"`
+	Scalar      *float64      `json:"scalar,omitempty"`
+	Duration    time.Duration `json:"duration"`
+	Children    []*Plan       `json:"children,omitempty"`
+}
+
+// Explain evaluates a query and returns its plan, the root of which is the
+// query as written and has the optimized statement as its only child.
+// Assignments and mutations are explained without being persisted.
+func (db *Database) Explain(query string) (*Plan, error) {
+	queryParser := parser.NewParser(lexer.NewLexer(strings.NewReader(query)))
+	queryAST, err := queryParser.Parse()
+	if err != nil {
+		return nil, err
+	}
+	if node, ok := queryAST.(*ast.ExplainStmt); ok {
+		queryAST = node.Statement
+	}
+	return db.explain(queryAST)
+}
+
+func (db *Database) explain(statement ast.Statement) (*Plan, error) {
+	plan := &Plan{Node: "query", Query: statement.ToQuery()}
+
+	// the set assigned is checked for cycles and left out of wildcards as
+	// it would be by the query
+	name := ""
+	switch node := statement.(type) {
+	case *ast.AssignExpr:
+		name = node.Name
+		statement = node.Expr
+
+	case *ast.MutateExpr:
+		pattern, err := db.mutate(node)
+		if err != nil {
+			return nil, err
+		}
+		name = node.Name
+		statement = pattern
+
+	case *ast.DropStmt, *ast.RenameStmt, *ast.MembershipStmt, *ast.ExplainStmt:
+		return nil, fmt.Errorf("%w: unsupported statement: %s", ErrSyntax, statement.ToQuery())
+	}
+
+	statement, err := db.dereference(statement)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &explainer{
+		db:       db,
+		name:     name,
+		resolver: db.newResolver(name),
+		stack:    make([]*Plan, 0),
+	}
+	if _, err := e.resolver.require(ast.References(statement)); err != nil {
+		return nil, err
+	}
+	statement = optimizer.NewOptimizer(e.resolver.estimate).Optimize(statement)
+
+	start := time.Now()
+	switch node := statement.(type) {
+	case *ast.ComparisonExpr:
+		lhs, rhs := e.trace(node.LHS), e.trace(node.RHS)
+		child := &Plan{Node: "predicate", Query: node.ToQuery(), Children: []*Plan{lhs.plan, rhs.plan}}
+		result, err := ast.ComparisonExpr{Operator: node.Operator, LHS: lhs, RHS: rhs}.EvaluateBoolean(e.resolve)
+		if err != nil {
+			return nil, err
+		}
+		child.Evaluated = true
+		child.Boolean = &result
+		child.Duration = time.Since(start)
+		plan.Children = append(plan.Children, child)
+		plan.Boolean = &result
+
+	case *ast.CallExpr:
+		var child *Plan
+		var result float64
+		if ast.IsApproximation(node.Function) {
+			// estimated from sketches, the argument is not evaluated
+			child = &Plan{Node: "approximation", Query: node.ToQuery()}
+			result, err = node.EstimateScalar(e.resolver.sketch, e.resolve)
+		} else {
+			arg := e.trace(node.Arg)
+			child = &Plan{Node: "function", Query: node.ToQuery(), Children: []*Plan{arg.plan}}
+			result, err = ast.CallExpr{Function: node.Function, Arg: arg}.EvaluateScalar(e.resolve)
+		}
+		if err != nil {
+			return nil, err
+		}
+		child.Evaluated = true
+		child.Scalar = &result
+		child.Duration = time.Since(start)
+		plan.Children = append(plan.Children, child)
+		plan.Scalar = &result
+
+	case ast.Node:
+		child := e.trace(node)
+		items, err := child.Evaluate(e.resolve)
+		if err != nil {
+			return nil, err
+		}
+		plan.Children = append(plan.Children, child.plan)
+		plan.Cardinality = items.Length()
+
+	default:
+		return nil, fmt.Errorf("%w: unsupported statement: %s", ErrSyntax, statement.ToQuery())
+	}
+	plan.Evaluated = true
+	plan.Duration = time.Since(start)
+	return plan, nil
+}
+
+// explainer evaluates a statement whose nodes are wrapped so that each of
+// them records its cardinality and evaluation time in its own plan. Named
+// sets are not memoized, every reference is expanded.
+type explainer struct {
+	db       *Database
+	name     string
+	resolver *resolver
+	stack    []*Plan
+}
+
+type tracedNode struct {
+	node      ast.Node
+	plan      *Plan
+	explainer *explainer
+}
+
+func (n tracedNode) Evaluate(cb func(string) (*ast.ResolvedSet, error)) (*sets.Set, error) {
+	e := n.explainer
+	e.stack = append(e.stack, n.plan)
+	defer func() {
+		e.stack = e.stack[:len(e.stack)-1]
+	}()
+
+	start := time.Now()
+	items, err := n.node.Evaluate(cb)
+	if err != nil {
+		return nil, err
+	}
+	n.plan.Evaluated = true
+	n.plan.Cardinality = items.Length()
+	n.plan.Duration = time.Since(start)
+	return items, nil
+}
+
+func (n tracedNode) ToQuery() string {
+	return n.node.ToQuery()
+}
+
+// tracedFilter keeps a filter usable as such, its plan accounts for the
+// items it matched and the time spent matching them.
+type tracedFilter struct {
+	*tracedNode
+	filter ast.Filter
+}
+
+func (n tracedFilter) Contains(item sets.Item) bool {
+	start := time.Now()
+	contains := n.filter.Contains(item)
+	n.plan.Evaluated = true
+	n.plan.Duration += time.Since(start)
+	if contains {
+		n.plan.Cardinality++
+	}
+	return contains
+}
+
+func (n *tracedNode) wrapped() ast.Node {
+	if f, ok := n.node.(ast.Filter); ok {
+		return &tracedFilter{tracedNode: n, filter: f}
+	}
+	return n
+}
+
+// trace wraps a node and its children, the plans of the children are
+// attached to the plan of the node as they are wrapped.
+func (e *explainer) trace(node ast.Node) *tracedNode {
+	plan := &Plan{Node: planNode(node), Query: node.ToQuery()}
+
+	children := func(nodes []ast.Node) []ast.Node {
+		ret := make([]ast.Node, 0, len(nodes))
+		for _, child := range nodes {
+			// items are accounted for by the cardinality of their set
+			if _, ok := child.(*ast.Item); ok {
+				ret = append(ret, child)
+				continue
+			}
+			traced := e.trace(child)
+			plan.Children = append(plan.Children, traced.plan)
+			ret = append(ret, traced.wrapped())
+		}
+		return ret
+	}
+
+	switch n := node.(type) {
+	case *ast.BinaryExpr:
+		operands := children([]ast.Node{n.LHS, n.RHS})
+		node = &ast.BinaryExpr{Operator: n.Operator, LHS: operands[0], RHS: operands[1]}
+	case *ast.NaryExpr:
+		node = &ast.NaryExpr{Operator: n.Operator, Operands: children(n.Operands)}
+	case *ast.Set:
+		if n.Name != "" {
+			plan.Name = n.Name
+		} else {
+			node = &ast.Set{Node: children(n.Node)}
+		}
+	case *ast.Dereference:
+		node = &ast.Dereference{Expr: children([]ast.Node{n.Expr})[0]}
+	case *ast.TypeAssertion:
+		node = &ast.TypeAssertion{Expr: children([]ast.Node{n.Expr})[0], Type: n.Type}
+	case *ast.Comprehension:
+		node = &ast.Comprehension{Var: n.Var, Source: children([]ast.Node{n.Source})[0], Predicate: n.Predicate}
+	}
+
+	return &tracedNode{node: node, plan: plan, explainer: e}
+}
+
+// resolve expands a named set, it is called while the plan of that set is
+// on top of the stack. Sets matched by a wildcard have no node of their own,
+// their plan is attached to the plan of the wildcard as they are resolved.
+func (e *explainer) resolve(name string) (*ast.ResolvedSet, error) {
+	if ast.IsWildcard(name) {
+		return e.expand(name)
+	}
+
+	if len(e.stack) != 0 && e.stack[len(e.stack)-1].Node == "wildcard" {
+		plan := &Plan{Node: "set", Query: name, Name: name}
+		parent := e.stack[len(e.stack)-1]
+		parent.Children = append(parent.Children, plan)
+
+		e.stack = append(e.stack, plan)
+		defer func() {
+			e.stack = e.stack[:len(e.stack)-1]
+		}()
+
+		start := time.Now()
+		resolved, err := e.resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		plan.Evaluated = true
+		plan.Cardinality = resolved.Items.Length()
+		plan.Duration = time.Since(start)
+		return resolved, nil
+	}
+
+	info, err := e.db.backend.Info(name)
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := e.db.pattern(name)
+	if err != nil {
+		return nil, err
+	}
+
+	traced := e.trace(e.resolver.optimize(pattern))
+	if len(e.stack) != 0 {
+		plan := e.stack[len(e.stack)-1]
+		plan.Pattern = pattern.ToQuery()
+		plan.DependsOn = info.DependsOn
+		plan.Children = append(plan.Children, traced.plan)
+	}
+
+	items, err := traced.Evaluate(e.resolve)
+	if err != nil {
+		return nil, err
+	}
+	return ast.NewMaterializedSet(name, pattern, items), nil
+}
+
+// expand resolves a wildcard to the sets it matches, leaving out the sets
+// being expanded as the resolver does.
+func (e *explainer) expand(wildcard string) (*ast.ResolvedSet, error) {
+	excluded := []string{e.name}
+	for _, plan := range e.stack {
+		if plan.Node == "set" {
+			excluded = append(excluded, plan.Name)
+		}
+	}
+	matched, err := e.db.expand(wildcard, excluded)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(matched))
+	for _, setInfo := range matched {
+		names = append(names, setInfo.Name)
+	}
+	return &ast.ResolvedSet{Name: wildcard, Names: names}, nil
+}
+
+func planNode(node ast.Node) string {
+	switch n := node.(type) {
+	case *ast.BinaryExpr:
+		return operationName(n.Operator)
+	case *ast.NaryExpr:
+		return operationName(n.Operator)
+	case *ast.Set:
+		if n.Name != "" {
+			return "set"
+		}
+		return "inline set"
+	case *ast.Item:
+		return "item"
+	case *ast.Dereference:
+		return "dereference"
+	case *ast.Range:
+		return "range"
+	case *ast.Comprehension:
+		return "comprehension"
+	case *ast.Wildcard:
+		return "wildcard"
+	case *ast.TypeAssertion:
+		return "type assertion"
+	default:
+		return "expression"
+	}
+}
+
+func operationName(operator lexer.TokenType) string {
+	switch operator {
+	case lexer.UNION:
+		return "union"
+	case lexer.INTERSECTION:
+		return "intersection"
+	case lexer.DIFFERENCE:
+		return "difference"
+	case lexer.SYMMETRIC_DIFFERENCE:
+		return "symmetric difference"
+	default:
+		return operator.String()
+	}
+}
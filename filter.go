@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package setdb
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/poolpOrg/go-setdb/query/ast"
+	"github.com/poolpOrg/go-setdb/sets"
+)
+
+// filters keeps the Bloom filters of sets decoded in memory as they are
+// loaded from the backend. A filter is dropped whenever its set is
+// persisted or deleted, as cache entries are, and a nil filter records a
+// set persisted without one.
+type filters struct {
+	mu      sync.Mutex
+	entries map[string]*sets.BloomFilter
+
+	// generation changes with every invalidation, so that a filter loaded
+	// while its set was being persisted isn't kept
+	generation uint64
+}
+
+func newFilters() *filters {
+	return &filters{
+		entries: make(map[string]*sets.BloomFilter),
+	}
+}
+
+func (f *filters) get(name string) (*sets.BloomFilter, bool, uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	filter, exists := f.entries[name]
+	return filter, exists, f.generation
+}
+
+func (f *filters) put(name string, filter *sets.BloomFilter, generation uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.generation == generation {
+		f.entries[name] = filter
+	}
+}
+
+func (f *filters) invalidate(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.entries, name)
+	f.generation++
+}
+
+func (db *Database) filter(name string) (*sets.BloomFilter, error) {
+	filter, exists, generation := db.filters.get(name)
+	if exists {
+		return filter, nil
+	}
+
+	serialized, err := db.backend.Filter(name)
+	if err != nil {
+		return nil, err
+	}
+	if serialized != nil {
+		filter = &sets.BloomFilter{}
+		if err := filter.UnmarshalBinary(serialized); err != nil {
+			return nil, err
+		}
+	}
+	db.filters.put(name, filter, generation)
+	return filter, nil
+}
+
+// Contains returns true if a persisted set holds item. The Bloom filter of
+// the set answers most negatives without evaluating it, otherwise the set is
+// evaluated and looked up.
+func (db *Database) Contains(name string, item sets.Item) (bool, error) {
+	// wildcards are not set names
+	if ast.IsWildcard(name) {
+		return false, fmt.Errorf("%w: %s", ErrSetNotFound, name)
+	}
+
+	filter, err := db.filter(name)
+	if err != nil {
+		return false, err
+	}
+	if filter != nil && !filter.MayContain(item) {
+		return false, nil
+	}
+
+	resolvedSet, err := db.newResolver("").resolve(name)
+	if err != nil {
+		return false, err
+	}
+	return resolvedSet.Items.Contains(item), nil
+}
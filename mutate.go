@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package setdb
+
+import (
+	"fmt"
+
+	"github.com/poolpOrg/go-setdb/query/ast"
+	"github.com/poolpOrg/go-setdb/query/lexer"
+)
+
+// mutate returns the pattern of a set once the items of a mutation have been
+// added to or removed from it. The items are evaluated at mutation time, and
+// the literal part of the pattern is edited whenever there is one so that
+// repeated mutations don't keep wrapping the pattern.
+func (db *Database) mutate(node *ast.MutateExpr) (ast.Node, error) {
+	items, err := db.snapshot(node.Expr)
+	if err != nil {
+		return nil, err
+	}
+
+	pattern, err := db.pattern(node.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(items.Node) == 0 {
+		return pattern, nil
+	}
+
+	switch node.Operator {
+	case lexer.ADD_ASSIGN:
+		return addItems(pattern, items.Node), nil
+	case lexer.REMOVE_ASSIGN:
+		return removeItems(pattern, items.Node), nil
+	default:
+		return nil, fmt.Errorf("unknown mutation: %s", node.Operator.String())
+	}
+}
+
+func isInlineSet(node ast.Node) bool {
+	set, ok := node.(*ast.Set)
+	return ok && set.Name == ""
+}
+
+// isLiteralSet returns true if node is an inline set made of items only, in
+// which case its content is known without evaluation.
+func isLiteralSet(node ast.Node) bool {
+	if !isInlineSet(node) {
+		return false
+	}
+	for _, item := range node.(*ast.Set).Node {
+		if _, ok := item.(*ast.Item); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func containsItem(nodes []ast.Node, item ast.Node) bool {
+	for _, node := range nodes {
+		if node.ToQuery() == item.ToQuery() {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutItems(nodes []ast.Node, items []ast.Node) []ast.Node {
+	ret := make([]ast.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if _, ok := node.(*ast.Item); ok && containsItem(items, node) {
+			continue
+		}
+		ret = append(ret, node)
+	}
+	return ret
+}
+
+func addItems(pattern ast.Node, items []ast.Node) ast.Node {
+	switch node := pattern.(type) {
+	case *ast.TypeAssertion:
+		node.Expr = addItems(node.Expr, items)
+		return node
+
+	case *ast.Set:
+		if node.Name != "" {
+			break
+		}
+		for _, item := range items {
+			if !containsItem(node.Node, item) {
+				node.Node = append(node.Node, item)
+			}
+		}
+		return node
+
+	case *ast.BinaryExpr:
+		if node.Operator == lexer.UNION && isInlineSet(node.RHS) {
+			node.RHS = addItems(node.RHS, items)
+			return node
+		}
+
+		// (L - R) | I is (L | I) - (R - I) as long as R has no references
+		if node.Operator == lexer.DIFFERENCE && isLiteralSet(node.RHS) {
+			rhs := node.RHS.(*ast.Set)
+			rhs.Node = withoutItems(rhs.Node, items)
+			if len(rhs.Node) == 0 {
+				return addItems(node.LHS, items)
+			}
+			node.LHS = addItems(node.LHS, items)
+			return node
+		}
+	}
+
+	return &ast.BinaryExpr{
+		Operator: lexer.UNION,
+		LHS:      pattern,
+		RHS:      &ast.Set{Node: items},
+	}
+}
+
+func removeItems(pattern ast.Node, items []ast.Node) ast.Node {
+	switch node := pattern.(type) {
+	case *ast.TypeAssertion:
+		node.Expr = removeItems(node.Expr, items)
+		return node
+
+	case *ast.Set:
+		if isLiteralSet(node) {
+			node.Node = withoutItems(node.Node, items)
+			return node
+		}
+
+	case *ast.BinaryExpr:
+		if node.Operator == lexer.DIFFERENCE && isInlineSet(node.RHS) {
+			node.RHS = addItems(node.RHS, items)
+			return node
+		}
+	}
+
+	return &ast.BinaryExpr{
+		Operator: lexer.DIFFERENCE,
+		LHS:      pattern,
+		RHS:      &ast.Set{Node: items},
+	}
+}
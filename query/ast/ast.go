@@ -17,7 +17,9 @@
 package ast
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/poolpOrg/go-setdb/query/lexer"
 	"github.com/poolpOrg/go-setdb/sets"
@@ -26,6 +28,10 @@ import (
 type ResolvedSet struct {
 	Name    string
 	Pattern Node
+	Items   *sets.Set
+
+	// Names holds the names of the sets matching a wildcard reference
+	Names []string
 }
 
 func NewResolvedSet(name string, pattern Node) *ResolvedSet {
@@ -35,11 +41,36 @@ func NewResolvedSet(name string, pattern Node) *ResolvedSet {
 	}
 }
 
+// NewMaterializedSet returns a resolved set whose pattern has already been
+// evaluated, Items is used as is instead of evaluating the pattern again.
+func NewMaterializedSet(name string, pattern Node, items *sets.Set) *ResolvedSet {
+	return &ResolvedSet{
+		Name:    name,
+		Pattern: pattern,
+		Items:   items,
+	}
+}
+
+type Statement interface {
+	ToQuery() string
+}
+
 type Node interface {
 	Evaluate(func(string) (*ResolvedSet, error)) (*sets.Set, error)
 	ToQuery() string
 }
 
+type BooleanNode interface {
+	EvaluateBoolean(func(string) (*ResolvedSet, error)) (bool, error)
+	ToQuery() string
+}
+
+// ScalarNode is implemented by aggregates, which evaluate to a number.
+type ScalarNode interface {
+	EvaluateScalar(func(string) (*ResolvedSet, error)) (float64, error)
+	ToQuery() string
+}
+
 type AssignExpr struct {
 	Name string
 	Expr Node
@@ -50,7 +81,186 @@ func (n AssignExpr) Evaluate(cb func(string) (*ResolvedSet, error)) (*sets.Set,
 }
 
 func (n AssignExpr) ToQuery() string {
-	return fmt.Sprintf("%s = %s", n.Name, n.Expr.ToQuery())
+	return fmt.Sprintf("%s = %s", lexer.QuoteIdent(n.Name), n.Expr.ToQuery())
+}
+
+// MutateExpr adds items to or removes items from a set, it evaluates to the
+// content the set will have once the statement is applied.
+type MutateExpr struct {
+	Name     string
+	Operator lexer.TokenType
+	Expr     Node
+}
+
+func (n MutateExpr) Evaluate(cb func(string) (*ResolvedSet, error)) (*sets.Set, error) {
+	var op func(...*sets.Set) *sets.Set
+	switch n.Operator {
+	case lexer.ADD_ASSIGN:
+		op = sets.Union
+	case lexer.REMOVE_ASSIGN:
+		op = sets.Difference
+	default:
+		return nil, fmt.Errorf("unknown mutation: %s", n.Operator.String())
+	}
+
+	target, err := Set{Name: n.Name}.Evaluate(cb)
+	if err != nil {
+		return nil, err
+	}
+	items, err := n.Expr.Evaluate(cb)
+	if err != nil {
+		return nil, err
+	}
+	return op(target, items), nil
+}
+
+func (n MutateExpr) ToQuery() string {
+	return fmt.Sprintf("%s %s %s", lexer.QuoteIdent(n.Name), n.Operator.String(), n.Expr.ToQuery())
+}
+
+type DropStmt struct {
+	Name    string
+	Cascade bool
+}
+
+func (n DropStmt) ToQuery() string {
+	if n.Cascade {
+		return fmt.Sprintf("DROP %s CASCADE", lexer.QuoteIdent(n.Name))
+	}
+	return fmt.Sprintf("DROP %s", lexer.QuoteIdent(n.Name))
+}
+
+type RenameStmt struct {
+	Name    string
+	NewName string
+	Cascade bool
+}
+
+func (n RenameStmt) ToQuery() string {
+	if n.Cascade {
+		return fmt.Sprintf("RENAME %s TO %s CASCADE", lexer.QuoteIdent(n.Name), lexer.QuoteIdent(n.NewName))
+	}
+	return fmt.Sprintf("RENAME %s TO %s", lexer.QuoteIdent(n.Name), lexer.QuoteIdent(n.NewName))
+}
+
+// MembershipStmt looks up the persisted sets containing an item.
+type MembershipStmt struct {
+	Item *Item
+}
+
+func (n MembershipStmt) ToQuery() string {
+	return fmt.Sprintf("MEMBERSHIP %s", n.Item.ToQuery())
+}
+
+// ExplainStmt describes how a statement is evaluated instead of returning
+// its result, assignments and mutations are explained but not applied.
+type ExplainStmt struct {
+	Statement Statement
+}
+
+func (n ExplainStmt) ToQuery() string {
+	return fmt.Sprintf("EXPLAIN %s", n.Statement.ToQuery())
+}
+
+// CallExpr applies an aggregate function to the items of a set.
+type CallExpr struct {
+	Function string
+	Arg      Node
+}
+
+var aggregates = map[string]func(*sets.Set) (float64, error){
+	"count": func(set *sets.Set) (float64, error) {
+		return float64(set.Length()), nil
+	},
+	"sum": func(set *sets.Set) (float64, error) {
+		values, err := numericValues("sum", set)
+		if err != nil {
+			return 0, err
+		}
+		var sum float64
+		for _, value := range values {
+			sum += value
+		}
+		return sum, nil
+	},
+	"min": func(set *sets.Set) (float64, error) {
+		values, err := numericValues("min", set)
+		if err != nil {
+			return 0, err
+		}
+		if len(values) == 0 {
+			return 0, fmt.Errorf("%w: min of an empty set", ErrInvalidOperand)
+		}
+		ret := values[0]
+		for _, value := range values[1:] {
+			if value < ret {
+				ret = value
+			}
+		}
+		return ret, nil
+	},
+	"max": func(set *sets.Set) (float64, error) {
+		values, err := numericValues("max", set)
+		if err != nil {
+			return 0, err
+		}
+		if len(values) == 0 {
+			return 0, fmt.Errorf("%w: max of an empty set", ErrInvalidOperand)
+		}
+		ret := values[0]
+		for _, value := range values[1:] {
+			if value > ret {
+				ret = value
+			}
+		}
+		return ret, nil
+	},
+}
+
+// IsAggregate returns true if name is a known aggregate function.
+func IsAggregate(name string) bool {
+	_, exists := aggregates[name]
+	return exists || IsApproximation(name)
+}
+
+func numericValues(function string, set *sets.Set) ([]float64, error) {
+	values := make([]float64, 0, set.Length())
+	for _, item := range set.ItemsList() {
+		if !item.IsNumber() {
+			return nil, fmt.Errorf("%w: %s: %s is not a number", ErrTypeMismatch, function, item)
+		}
+		values = append(values, item.Float())
+	}
+	return values, nil
+}
+
+// EvaluateScalar evaluates an aggregate, approximations are estimated from
+// sketches of the sets their argument references, once evaluated.
+func (n CallExpr) EvaluateScalar(cb func(string) (*ResolvedSet, error)) (float64, error) {
+	if IsApproximation(n.Function) {
+		sketch := func(name string) (*sets.HyperLogLog, error) {
+			items, err := Set{Name: name}.Evaluate(cb)
+			if err != nil {
+				return nil, err
+			}
+			return items.Sketch(), nil
+		}
+		return n.EstimateScalar(sketch, cb)
+	}
+
+	aggregate, exists := aggregates[n.Function]
+	if !exists {
+		return 0, fmt.Errorf("unknown function: %s", n.Function)
+	}
+	items, err := n.Arg.Evaluate(cb)
+	if err != nil {
+		return 0, err
+	}
+	return aggregate(items)
+}
+
+func (n CallExpr) ToQuery() string {
+	return fmt.Sprintf("%s(%s)", n.Function, n.Arg.ToQuery())
 }
 
 type BinaryExpr struct {
@@ -60,18 +270,25 @@ type BinaryExpr struct {
 }
 
 func (n BinaryExpr) Evaluate(cb func(string) (*ResolvedSet, error)) (*sets.Set, error) {
-	var op func(...*sets.Set) *sets.Set
+	op, err := Operation(n.Operator)
+	if err != nil {
+		return nil, err
+	}
+
+	// a filter is applied to the other operand rather than enumerated
+	// whenever the operation allows it
 	switch n.Operator {
-	case lexer.UNION:
-		op = sets.Union
 	case lexer.INTERSECTION:
-		op = sets.Intersection
+		if f, ok := n.RHS.(Filter); ok {
+			return filterNode(n.LHS, f, true, cb)
+		}
+		if f, ok := n.LHS.(Filter); ok {
+			return filterNode(n.RHS, f, true, cb)
+		}
 	case lexer.DIFFERENCE:
-		op = sets.Difference
-	case lexer.SYMMETRIC_DIFFERENCE:
-		op = sets.SymmetricDifference
-	default:
-		panic("unknown operation: " + n.Operator.String())
+		if f, ok := n.RHS.(Filter); ok {
+			return filterNode(n.LHS, f, false, cb)
+		}
 	}
 
 	lhs, err := n.LHS.Evaluate(cb)
@@ -87,6 +304,133 @@ func (n BinaryExpr) Evaluate(cb func(string) (*ResolvedSet, error)) (*sets.Set,
 }
 
 func (n BinaryExpr) ToQuery() string {
+	return fmt.Sprintf("%s%s%s", groupQuery(n.LHS), n.Operator.String(), groupQuery(n.RHS))
+}
+
+// NaryExpr applies an associative operator to any number of operands, it is
+// produced by the optimizer when flattening chains of the same operator.
+type NaryExpr struct {
+	Operator lexer.TokenType
+	Operands []Node
+}
+
+func (n NaryExpr) Evaluate(cb func(string) (*ResolvedSet, error)) (*sets.Set, error) {
+	op, err := Operation(n.Operator)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := n.Operands
+	filters := make([]Filter, 0)
+	if n.Operator == lexer.INTERSECTION {
+		// filters are applied to the intersection of the other operands
+		// rather than enumerated, unless there is nothing else to filter
+		nodes = make([]Node, 0, len(n.Operands))
+		for _, operand := range n.Operands {
+			if f, ok := operand.(Filter); ok {
+				filters = append(filters, f)
+			} else {
+				nodes = append(nodes, operand)
+			}
+		}
+		if len(nodes) == 0 {
+			nodes = append(nodes, n.Operands[0])
+			filters = filters[1:]
+		}
+	}
+
+	operands := make([]*sets.Set, 0, len(nodes))
+	for _, operand := range nodes {
+		items, err := operand.Evaluate(cb)
+		if err != nil {
+			return nil, err
+		}
+		// nothing intersects with an empty set, the remaining operands
+		// don't need to be evaluated
+		if n.Operator == lexer.INTERSECTION && items.Length() == 0 {
+			return sets.NewSet(), nil
+		}
+		operands = append(operands, items)
+	}
+
+	result := op(operands...)
+	for _, f := range filters {
+		result = filter(result, f, true)
+	}
+	return result, nil
+}
+
+func (n NaryExpr) ToQuery() string {
+	operands := make([]string, 0, len(n.Operands))
+	for _, operand := range n.Operands {
+		operands = append(operands, groupQuery(operand))
+	}
+	return strings.Join(operands, n.Operator.String())
+}
+
+// Operation returns the function implementing a set operator.
+func Operation(operator lexer.TokenType) (func(...*sets.Set) *sets.Set, error) {
+	switch operator {
+	case lexer.UNION:
+		return sets.Union, nil
+	case lexer.INTERSECTION:
+		return sets.Intersection, nil
+	case lexer.DIFFERENCE:
+		return sets.Difference, nil
+	case lexer.SYMMETRIC_DIFFERENCE:
+		return sets.SymmetricDifference, nil
+	default:
+		return nil, fmt.Errorf("unknown operation: %s", operator.String())
+	}
+}
+
+// groupQuery parenthesizes nested operations so that the query re-parses
+// to the same tree regardless of operator precedence.
+func groupQuery(node Node) string {
+	switch node.(type) {
+	case *BinaryExpr, *NaryExpr:
+		return "(" + node.ToQuery() + ")"
+	}
+	return node.ToQuery()
+}
+
+type ComparisonExpr struct {
+	Operator lexer.TokenType
+	LHS      Node
+	RHS      Node
+}
+
+func (n ComparisonExpr) EvaluateBoolean(cb func(string) (*ResolvedSet, error)) (bool, error) {
+	lhs, err := n.LHS.Evaluate(cb)
+	if err != nil {
+		return false, err
+	}
+	rhs, err := n.RHS.Evaluate(cb)
+	if err != nil {
+		return false, err
+	}
+
+	switch n.Operator {
+	case lexer.SUBSET:
+		return lhs.SubsetOf(rhs) || lhs.SameAs(rhs), nil
+	case lexer.PROPER_SUBSET:
+		return lhs.SubsetOf(rhs), nil
+	case lexer.SUPERSET:
+		return lhs.SupersetOf(rhs) || lhs.SameAs(rhs), nil
+	case lexer.PROPER_SUPERSET:
+		return lhs.SupersetOf(rhs), nil
+	case lexer.EQUAL:
+		return lhs.SameAs(rhs), nil
+	case lexer.NOT_EQUAL:
+		return !lhs.SameAs(rhs), nil
+	case lexer.DISJOINT:
+		return lhs.DisjointOf(rhs), nil
+	default:
+		return false, fmt.Errorf("unknown predicate: %s", n.Operator.String())
+	}
+}
+
+func (n ComparisonExpr) ToQuery() string {
 	return fmt.Sprintf("%s%s%s", n.LHS.ToQuery(), n.Operator.String(), n.RHS.ToQuery())
 }
 
@@ -101,17 +445,30 @@ func (n Set) Evaluate(cb func(string) (*ResolvedSet, error)) (*sets.Set, error)
 		if err != nil {
 			return nil, err
 		}
+		if resolvedSet.Items != nil {
+			return resolvedSet.Items, nil
+		}
 		return resolvedSet.Pattern.Evaluate(cb)
 	}
 
-	resolvedSets := make([]*sets.Set, 0)
+	// literal items are added to a single set rather than unioned one by
+	// one, which would merge the whole set for every item
+	literals := sets.NewSet()
+	resolvedSets := []*sets.Set{literals}
 	for _, item := range n.Node {
+		if item, ok := item.(*Item); ok {
+			literals.Add(item.Value)
+			continue
+		}
 		results, err := item.Evaluate(cb)
 		if err != nil {
 			return nil, err
 		}
 		resolvedSets = append(resolvedSets, results)
 	}
+	if len(resolvedSets) == 1 {
+		return literals, nil
+	}
 	return sets.Union(resolvedSets...), nil
 }
 
@@ -129,18 +486,164 @@ func (n Set) ToQuery() string {
 		return buf
 
 	} else {
-		return name
+		return lexer.QuoteIdent(name)
 	}
 }
 
+// Wildcard references every persisted set whose name matches a glob, it
+// evaluates to their union unless another operator is given.
+type Wildcard struct {
+	Pattern  string
+	Operator lexer.TokenType
+}
+
+// IsWildcard returns true if a set name holds wildcards.
+func IsWildcard(name string) bool {
+	return strings.ContainsAny(name, "*?")
+}
+
+func (n Wildcard) Evaluate(cb func(string) (*ResolvedSet, error)) (*sets.Set, error) {
+	op, err := Operation(n.Operator)
+	if err != nil {
+		return nil, err
+	}
+
+	resolvedSet, err := cb(n.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(resolvedSet.Names) == 0 {
+		return sets.NewSet(), nil
+	}
+
+	operands := make([]*sets.Set, 0, len(resolvedSet.Names))
+	for _, name := range resolvedSet.Names {
+		items, err := Set{Name: name}.Evaluate(cb)
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, items)
+	}
+	return op(operands...), nil
+}
+
+func (n Wildcard) ToQuery() string {
+	if n.Operator == lexer.UNION {
+		return lexer.QuoteIdent(n.Pattern)
+	}
+	// grouped so that the operator doesn't merge with a preceding one
+	return fmt.Sprintf("(%s%s)", n.Operator.String(), lexer.QuoteIdent(n.Pattern))
+}
+
+// Dereference evaluates to the content of its expression rather than to a
+// reference to it, it is expected to be replaced by an inline set holding a
+// snapshot of that content before being persisted.
+type Dereference struct {
+	Expr Node
+}
+
+func (n Dereference) Evaluate(cb func(string) (*ResolvedSet, error)) (*sets.Set, error) {
+	return n.Expr.Evaluate(cb)
+}
+
+func (n Dereference) ToQuery() string {
+	return "*" + groupQuery(n.Expr)
+}
+
 type Item struct {
-	Name string
+	Value sets.Item
 }
 
 func (n Item) Evaluate(cb func(string) (*ResolvedSet, error)) (*sets.Set, error) {
-	return sets.NewSet(n.Name), nil
+	return sets.NewSet(n.Value), nil
 }
 
 func (n Item) ToQuery() string {
-	return n.Name
+	return n.Value.String()
+}
+
+// ErrTypeMismatch is returned when evaluating a TypeAssertion over an item
+// of another type, or an aggregate over an item that isn't a number.
+var ErrTypeMismatch = errors.New("item type mismatch")
+
+// ErrInvalidOperand is returned when an operand can't be evaluated as a
+// query requires: a range too large to be enumerated, the minimum of an
+// empty set or too many sets to estimate.
+var ErrInvalidOperand = errors.New("invalid operand")
+
+// TypeAssertion requires every item of an expression to be of a type, it
+// is declared when assigning a set and checked whenever it is evaluated.
+type TypeAssertion struct {
+	Expr Node
+	Type sets.Type
+}
+
+func (n TypeAssertion) Evaluate(cb func(string) (*ResolvedSet, error)) (*sets.Set, error) {
+	items, err := n.Expr.Evaluate(cb)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items.ItemsList() {
+		if item.Type() != n.Type {
+			return nil, fmt.Errorf("%w: %s is not of type %s", ErrTypeMismatch, item, n.Type)
+		}
+	}
+	return items, nil
+}
+
+func (n TypeAssertion) ToQuery() string {
+	return fmt.Sprintf("%s AS %s", n.Expr.ToQuery(), n.Type)
+}
+
+// References returns the names of the sets a statement refers to, each
+// listed once and in order of appearance.
+func References(statement Statement) []string {
+	names := make([]string, 0)
+	seen := make(map[string]struct{})
+
+	var walk func(Statement)
+	walk = func(statement Statement) {
+		switch node := statement.(type) {
+		case *Set:
+			if node.Name != "" {
+				if _, exists := seen[node.Name]; !exists {
+					seen[node.Name] = struct{}{}
+					names = append(names, node.Name)
+				}
+			}
+			for _, item := range node.Node {
+				walk(item)
+			}
+		case *BinaryExpr:
+			walk(node.LHS)
+			walk(node.RHS)
+		case *NaryExpr:
+			for _, operand := range node.Operands {
+				walk(operand)
+			}
+		case *ComparisonExpr:
+			walk(node.LHS)
+			walk(node.RHS)
+		case *Wildcard:
+			if _, exists := seen[node.Pattern]; !exists {
+				seen[node.Pattern] = struct{}{}
+				names = append(names, node.Pattern)
+			}
+		case *Dereference:
+			walk(node.Expr)
+		case *TypeAssertion:
+			walk(node.Expr)
+		case *CallExpr:
+			walk(node.Arg)
+		case *Comprehension:
+			walk(node.Source)
+		case *AssignExpr:
+			walk(node.Expr)
+		case *MutateExpr:
+			walk(&Set{Name: node.Name})
+			walk(node.Expr)
+		}
+	}
+	walk(statement)
+	return names
 }
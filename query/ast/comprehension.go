@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ast
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/poolpOrg/go-setdb/query/lexer"
+	"github.com/poolpOrg/go-setdb/sets"
+)
+
+// ItemPredicate is implemented by the predicates of a comprehension, which
+// are evaluated against each item of its source.
+type ItemPredicate interface {
+	Match(item sets.Item) bool
+	ToQuery() string
+}
+
+// Comprehension holds the items of its source matching a predicate, the
+// variable naming the item being matched within the predicate.
+type Comprehension struct {
+	Var       string
+	Source    Node
+	Predicate ItemPredicate
+}
+
+func (n Comprehension) Evaluate(cb func(string) (*ResolvedSet, error)) (*sets.Set, error) {
+	items, err := n.Source.Evaluate(cb)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := sets.NewSet()
+	for _, item := range items.ItemsList() {
+		if n.Predicate.Match(item) {
+			ret.Add(item)
+		}
+	}
+	return ret, nil
+}
+
+func (n Comprehension) ToQuery() string {
+	return fmt.Sprintf("{%s in %s | %s}", lexer.QuoteIdent(n.Var), groupQuery(n.Source), n.Predicate.ToQuery())
+}
+
+// ItemComparison compares an item to a value:
+//
+//	~          matches a glob, where * matches any sequence and ? any character
+//	=~         matches a regular expression
+//	^=         starts with a prefix
+//	< <= > >=  compares to items of the same kind, numbers numerically and
+//	           strings lexicographically
+//	== !=      compares numbers numerically, other items by type and value
+type ItemComparison struct {
+	Var      string
+	Operator lexer.TokenType
+	Value    *Item
+
+	regexp *regexp.Regexp
+}
+
+func NewItemComparison(name string, operator lexer.TokenType, value *Item) (*ItemComparison, error) {
+	node := &ItemComparison{Var: name, Operator: operator, Value: value}
+
+	switch operator {
+	case lexer.GLOB:
+		re, err := Glob(value.Value.Text())
+		if err != nil {
+			return nil, err
+		}
+		node.regexp = re
+	case lexer.REGEX:
+		re, err := regexp.Compile(value.Value.Text())
+		if err != nil {
+			return nil, err
+		}
+		node.regexp = re
+	case lexer.PREFIX, lexer.PROPER_SUBSET, lexer.SUBSET, lexer.PROPER_SUPERSET, lexer.SUPERSET, lexer.EQUAL, lexer.NOT_EQUAL:
+	default:
+		return nil, fmt.Errorf("unknown item comparison: %s", operator.String())
+	}
+	return node, nil
+}
+
+func (n ItemComparison) Match(item sets.Item) bool {
+	switch n.Operator {
+	case lexer.GLOB, lexer.REGEX:
+		return n.regexp.MatchString(item.Text())
+	case lexer.PREFIX:
+		return strings.HasPrefix(item.Text(), n.Value.Value.Text())
+	case lexer.EQUAL:
+		return n.compare(item) == 0
+	case lexer.NOT_EQUAL:
+		return n.compare(item) != 0
+	}
+
+	// ordering comparisons don't match items of another kind than the value
+	value := n.Value.Value
+	if item.Type() != value.Type() && !(item.IsNumber() && value.IsNumber()) {
+		return false
+	}
+
+	cmp := n.compare(item)
+	switch n.Operator {
+	case lexer.PROPER_SUBSET:
+		return cmp < 0
+	case lexer.SUBSET:
+		return cmp <= 0
+	case lexer.PROPER_SUPERSET:
+		return cmp > 0
+	case lexer.SUPERSET:
+		return cmp >= 0
+	}
+	return false
+}
+
+// compare returns the order of item relative to the value, numbers are
+// compared numerically whatever their type.
+func (n ItemComparison) compare(item sets.Item) int {
+	value := n.Value.Value
+	if item.IsNumber() && value.IsNumber() && item.Type() != value.Type() {
+		switch lhs, rhs := item.Float(), value.Float(); {
+		case lhs < rhs:
+			return -1
+		case lhs > rhs:
+			return 1
+		default:
+			return 0
+		}
+	}
+	return sets.Compare(item, value)
+}
+
+func (n ItemComparison) ToQuery() string {
+	return fmt.Sprintf("%s %s %s", lexer.QuoteIdent(n.Var), n.Operator.String(), n.Value.ToQuery())
+}
+
+// LogicalExpr combines item predicates with && or ||.
+type LogicalExpr struct {
+	Operator lexer.TokenType
+	LHS      ItemPredicate
+	RHS      ItemPredicate
+}
+
+func (n LogicalExpr) Match(item sets.Item) bool {
+	if n.Operator == lexer.AND {
+		return n.LHS.Match(item) && n.RHS.Match(item)
+	}
+	return n.LHS.Match(item) || n.RHS.Match(item)
+}
+
+func (n LogicalExpr) ToQuery() string {
+	return fmt.Sprintf("%s %s %s", groupPredicate(n.LHS), n.Operator.String(), groupPredicate(n.RHS))
+}
+
+func groupPredicate(predicate ItemPredicate) string {
+	if _, ok := predicate.(*LogicalExpr); ok {
+		return "(" + predicate.ToQuery() + ")"
+	}
+	return predicate.ToQuery()
+}
+
+// Glob compiles a glob into an anchored regular expression, * matches any
+// sequence of characters and ? matches a single character.
+func Glob(pattern string) (*regexp.Regexp, error) {
+	var buf strings.Builder
+	buf.WriteString("(?s)^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			buf.WriteString(".*")
+		case '?':
+			buf.WriteString(".")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
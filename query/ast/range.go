@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ast
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/poolpOrg/go-setdb/sets"
+)
+
+// MaxRangeItems bounds the number of items a range can be enumerated into.
+const MaxRangeItems = 1 << 24
+
+// Filter is implemented by nodes which can tell whether an item belongs to
+// them without being enumerated, intersections and differences use it to
+// avoid materializing them.
+type Filter interface {
+	Contains(item sets.Item) bool
+}
+
+// Range holds the items between two bounds, inclusive. Bounds are either
+// both integers or both single characters, a range holds the same items
+// whether it is enumerated or used as a filter.
+type Range struct {
+	From *Item
+	To   *Item
+}
+
+func NewRange(from *Item, to *Item) (*Range, error) {
+	if from.Value.Type() != to.Value.Type() || (from.Value.Type() != sets.IntegerType && from.Value.Type() != sets.StringType) {
+		return nil, fmt.Errorf("range bounds must be both integers or both strings")
+	}
+	if from.Value.Type() == sets.StringType && (!isCharacter(from.Value) || !isCharacter(to.Value)) {
+		return nil, fmt.Errorf("range bounds must be single characters")
+	}
+	return &Range{From: from, To: to}, nil
+}
+
+func isCharacter(item sets.Item) bool {
+	return item.Type() == sets.StringType && utf8.RuneCountInString(item.Text()) == 1
+}
+
+func (n Range) Contains(item sets.Item) bool {
+	if item.Type() != n.From.Value.Type() {
+		return false
+	}
+	// a string range only enumerates single characters
+	if item.Type() == sets.StringType && !isCharacter(item) {
+		return false
+	}
+	return sets.Compare(n.From.Value, item) <= 0 && sets.Compare(item, n.To.Value) <= 0
+}
+
+// Length returns the number of items in the range, or false if it can't
+// be enumerated.
+func (n Range) Length() (int64, bool) {
+	if n.From.Value.Type() == sets.IntegerType {
+		from, to := n.From.Value.Integer(), n.To.Value.Integer()
+		if to < from {
+			return 0, true
+		}
+		// the difference may overflow for bounds far apart
+		if length := to - from + 1; length > 0 {
+			return length, true
+		}
+		return 0, false
+	}
+
+	first, _ := utf8.DecodeRuneInString(n.From.Value.Text())
+	last, _ := utf8.DecodeRuneInString(n.To.Value.Text())
+	if last < first {
+		return 0, true
+	}
+	return int64(last-first) + 1, true
+}
+
+func (n Range) Evaluate(cb func(string) (*ResolvedSet, error)) (*sets.Set, error) {
+	length, ok := n.Length()
+	if !ok {
+		return nil, fmt.Errorf("%w: range can't be enumerated: %s", ErrInvalidOperand, n.ToQuery())
+	}
+	if length > MaxRangeItems {
+		return nil, fmt.Errorf("%w: range is too large to be enumerated: %s", ErrInvalidOperand, n.ToQuery())
+	}
+
+	set := sets.NewSet()
+	if n.From.Value.Type() == sets.IntegerType {
+		from := n.From.Value.Integer()
+		for i := int64(0); i < length; i++ {
+			set.Add(sets.NewInteger(from + i))
+		}
+		return set, nil
+	}
+
+	first, _ := utf8.DecodeRuneInString(n.From.Value.Text())
+	for i := int64(0); i < length; i++ {
+		set.Add(sets.NewString(string(first + rune(i))))
+	}
+	return set, nil
+}
+
+func (n Range) ToQuery() string {
+	return n.From.ToQuery() + ".." + n.To.ToQuery()
+}
+
+// filter returns the items of a set that f contains, or those it doesn't
+// contain if contained is false.
+func filter(set *sets.Set, f Filter, contained bool) *sets.Set {
+	ret := sets.NewSet()
+	for _, item := range set.ItemsList() {
+		if f.Contains(item) == contained {
+			ret.Add(item)
+		}
+	}
+	return ret
+}
+
+func filterNode(node Node, f Filter, contained bool, cb func(string) (*ResolvedSet, error)) (*sets.Set, error) {
+	items, err := node.Evaluate(cb)
+	if err != nil {
+		return nil, err
+	}
+	return filter(items, f, contained), nil
+}
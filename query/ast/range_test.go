@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ast
+
+import (
+	"testing"
+
+	"github.com/poolpOrg/go-setdb/sets"
+)
+
+func TestNewRange(t *testing.T) {
+	tests := []struct {
+		from  sets.Item
+		to    sets.Item
+		valid bool
+	}{
+		{sets.NewInteger(1), sets.NewInteger(5), true},
+		{sets.NewString("a"), sets.NewString("e"), true},
+		{sets.NewString("é"), sets.NewString("ü"), true},
+		{sets.NewString("aa"), sets.NewString("ab"), false},
+		{sets.NewString("a"), sets.NewString("apple"), false},
+		{sets.NewString(""), sets.NewString("a"), false},
+		{sets.NewInteger(1), sets.NewString("a"), false},
+		{sets.NewBoolean(false), sets.NewBoolean(true), false},
+	}
+
+	for _, test := range tests {
+		_, err := NewRange(&Item{Value: test.from}, &Item{Value: test.to})
+		if (err == nil) != test.valid {
+			t.Errorf("NewRange(%s, %s): got %v, want valid=%v", test.from, test.to, err, test.valid)
+		}
+	}
+}
+
+// TestRangeContains checks that a range used as a filter holds exactly the
+// items it enumerates.
+func TestRangeContains(t *testing.T) {
+	probes := []sets.Item{
+		sets.NewString(""),
+		sets.NewString("a"),
+		sets.NewString("apple"),
+		sets.NewString("c"),
+		sets.NewString("e"),
+		sets.NewString("ee"),
+		sets.NewString("f"),
+		sets.NewString("A"),
+		sets.NewInteger(-1),
+		sets.NewInteger(0),
+		sets.NewInteger(3),
+		sets.NewInteger(5),
+		sets.NewInteger(6),
+		sets.NewBoolean(true),
+	}
+	for _, probe := range probes {
+		if probe.Type() == sets.IntegerType {
+			float, _ := sets.NewFloat(probe.Float())
+			probes = append(probes, float)
+		}
+	}
+
+	tests := []struct {
+		from sets.Item
+		to   sets.Item
+	}{
+		{sets.NewInteger(0), sets.NewInteger(5)},
+		{sets.NewInteger(5), sets.NewInteger(0)},
+		{sets.NewInteger(-1), sets.NewInteger(-1)},
+		{sets.NewString("a"), sets.NewString("e")},
+		{sets.NewString("e"), sets.NewString("a")},
+		{sets.NewString("A"), sets.NewString("z")},
+	}
+
+	for _, test := range tests {
+		r, err := NewRange(&Item{Value: test.from}, &Item{Value: test.to})
+		if err != nil {
+			t.Fatal(err)
+		}
+		enumerated, err := r.Evaluate(nil)
+		if err != nil {
+			t.Fatalf("%s: %v", r.ToQuery(), err)
+		}
+		for _, probe := range probes {
+			if r.Contains(probe) != enumerated.Contains(probe) {
+				t.Errorf("%s: Contains(%s) = %v, enumerated holds it: %v",
+					r.ToQuery(), probe, r.Contains(probe), enumerated.Contains(probe))
+			}
+		}
+		for _, item := range enumerated.ItemsList() {
+			if !r.Contains(item) {
+				t.Errorf("%s: Contains(%s) = false, enumerated holds it", r.ToQuery(), item)
+			}
+		}
+	}
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ast
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/poolpOrg/go-setdb/query/lexer"
+	"github.com/poolpOrg/go-setdb/sets"
+)
+
+// approximations are aggregates estimated from sketches of the sets their
+// argument references rather than from its items.
+var approximations = map[string]struct{}{
+	"approx_count": {},
+}
+
+// IsApproximation returns true if name is an approximate aggregate.
+func IsApproximation(name string) bool {
+	_, exists := approximations[name]
+	return exists
+}
+
+// maxSketchOperands bounds the number of sets an estimate combines, as it
+// requires merging the sketches of every combination of them.
+const maxSketchOperands = 8
+
+// EstimateScalar evaluates an approximate aggregate, sketch resolving the
+// name of a set to a sketch of its items. Only set references and set
+// operations are estimated, other expressions are evaluated with cb and
+// sketched.
+func (n CallExpr) EstimateScalar(sketch func(string) (*sets.HyperLogLog, error), cb func(string) (*ResolvedSet, error)) (float64, error) {
+	if !IsApproximation(n.Function) {
+		return n.EvaluateScalar(cb)
+	}
+
+	v := &venn{
+		sketch:    sketch,
+		cb:        cb,
+		names:     make(map[string]uint),
+		wildcards: make(map[string][]string),
+	}
+
+	// operands are counted before any sketch is fetched
+	names := make(map[string]struct{})
+	anonymous, err := v.operands(n.Arg, names)
+	if err != nil {
+		return 0, err
+	}
+	if count := anonymous + len(names); count > maxSketchOperands {
+		return 0, fmt.Errorf("%w: %s: too many sets to estimate: %d", ErrInvalidOperand, n.Function, count)
+	}
+
+	member, err := v.region(n.Arg)
+	if err != nil {
+		return 0, err
+	}
+	return v.count(member), nil
+}
+
+// venn estimates the cardinality of an expression from the sketches of its
+// operands: the expression tells which regions of their Venn diagram are
+// part of the result, and the cardinality of each region is derived by
+// inclusion-exclusion from the estimated cardinalities of unions.
+type venn struct {
+	sketch    func(string) (*sets.HyperLogLog, error)
+	cb        func(string) (*ResolvedSet, error)
+	names     map[string]uint
+	wildcards map[string][]string
+	sketches  []*sets.HyperLogLog
+}
+
+// operands collects the names of the sets node references, wildcards being
+// resolved to the sets they match, and returns the number of its other
+// operands which are evaluated and sketched.
+func (v *venn) operands(node Node, names map[string]struct{}) (int, error) {
+	var children []Node
+	switch node := node.(type) {
+	case *Set:
+		if node.Name == "" {
+			return 1, nil
+		}
+		names[node.Name] = struct{}{}
+		return 0, nil
+	case *BinaryExpr:
+		children = []Node{node.LHS, node.RHS}
+	case *NaryExpr:
+		children = node.Operands
+	case *Wildcard:
+		if _, exists := v.wildcards[node.Pattern]; !exists {
+			resolvedSet, err := v.cb(node.Pattern)
+			if err != nil {
+				return 0, err
+			}
+			v.wildcards[node.Pattern] = resolvedSet.Names
+		}
+		for _, name := range v.wildcards[node.Pattern] {
+			names[name] = struct{}{}
+		}
+		return 0, nil
+	default:
+		return 1, nil
+	}
+
+	anonymous := 0
+	for _, child := range children {
+		count, err := v.operands(child, names)
+		if err != nil {
+			return 0, err
+		}
+		anonymous += count
+	}
+	return anonymous, nil
+}
+
+// region returns a function telling if the region of the items belonging
+// to the operands whose bits are set in a mask is part of node.
+func (v *venn) region(node Node) (func(uint) bool, error) {
+	switch node := node.(type) {
+	case *Set:
+		if node.Name != "" {
+			return v.operand(node.Name)
+		}
+	case *BinaryExpr:
+		return v.operation(node.Operator, []Node{node.LHS, node.RHS})
+	case *NaryExpr:
+		return v.operation(node.Operator, node.Operands)
+	case *Wildcard:
+		matched, exists := v.wildcards[node.Pattern]
+		if !exists {
+			resolvedSet, err := v.cb(node.Pattern)
+			if err != nil {
+				return nil, err
+			}
+			matched = resolvedSet.Names
+		}
+		operands := make([]Node, 0, len(matched))
+		for _, name := range matched {
+			operands = append(operands, &Set{Name: name})
+		}
+		return v.operation(node.Operator, operands)
+	}
+
+	items, err := node.Evaluate(v.cb)
+	if err != nil {
+		return nil, err
+	}
+	return v.add(items.Sketch()), nil
+}
+
+func (v *venn) operand(name string) (func(uint) bool, error) {
+	if bit, exists := v.names[name]; exists {
+		return func(mask uint) bool { return mask&bit != 0 }, nil
+	}
+	sketch, err := v.sketch(name)
+	if err != nil {
+		return nil, err
+	}
+	member := v.add(sketch)
+	v.names[name] = 1 << (len(v.sketches) - 1)
+	return member, nil
+}
+
+func (v *venn) add(sketch *sets.HyperLogLog) func(uint) bool {
+	v.sketches = append(v.sketches, sketch)
+	bit := uint(1) << (len(v.sketches) - 1)
+	return func(mask uint) bool { return mask&bit != 0 }
+}
+
+func (v *venn) operation(operator lexer.TokenType, operands []Node) (func(uint) bool, error) {
+	members := make([]func(uint) bool, 0, len(operands))
+	for _, operand := range operands {
+		member, err := v.region(operand)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	if len(members) == 0 {
+		return func(uint) bool { return false }, nil
+	}
+
+	switch operator {
+	case lexer.UNION:
+		return func(mask uint) bool {
+			for _, member := range members {
+				if member(mask) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case lexer.INTERSECTION:
+		return func(mask uint) bool {
+			for _, member := range members {
+				if !member(mask) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	case lexer.DIFFERENCE:
+		return func(mask uint) bool {
+			if !members[0](mask) {
+				return false
+			}
+			for _, member := range members[1:] {
+				if member(mask) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	case lexer.SYMMETRIC_DIFFERENCE:
+		// like sets.SymmetricDifference, items found in exactly one operand
+		return func(mask uint) bool {
+			count := 0
+			for _, member := range members {
+				if member(mask) {
+					count++
+				}
+			}
+			return count == 1
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown operation: %s", operator.String())
+}
+
+// count sums the estimated cardinalities of the regions part of the result.
+func (v *venn) count(member func(uint) bool) float64 {
+	full := uint(1)<<len(v.sketches) - 1
+
+	// unions[mask] estimates the cardinality of the union of the operands
+	// whose bits are set in mask
+	unions := make([]float64, full+1)
+	merged := make([]*sets.HyperLogLog, full+1)
+	for mask := uint(1); mask <= full; mask++ {
+		i := bits.TrailingZeros(mask)
+		rest := mask &^ (1 << i)
+		if rest == 0 {
+			merged[mask] = v.sketches[i]
+		} else {
+			merged[mask] = merged[rest].Clone()
+			merged[mask].Merge(v.sketches[i])
+		}
+		unions[mask] = merged[mask].Count()
+	}
+
+	// the items belonging to the operands of a region and to none of the
+	// others are those outside the others, minus those outside the others
+	// and any of the region operands, and so on
+	total := 0.0
+	for region := uint(1); region <= full; region++ {
+		if !member(region) {
+			continue
+		}
+		others := full &^ region
+		for subset := region; ; subset = (subset - 1) & region {
+			if bits.OnesCount(subset)%2 == 0 {
+				total -= unions[others|subset]
+			} else {
+				total += unions[others|subset]
+			}
+			if subset == 0 {
+				break
+			}
+		}
+	}
+	return math.Max(0, math.Round(total))
+}
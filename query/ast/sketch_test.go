@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ast
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/poolpOrg/go-setdb/query/lexer"
+	"github.com/poolpOrg/go-setdb/sets"
+)
+
+// span returns a set of the integers from lo to hi excluded.
+func span(lo int64, hi int64) *sets.Set {
+	set := sets.NewSet()
+	for i := lo; i < hi; i++ {
+		set.Add(sets.NewInteger(i))
+	}
+	return set
+}
+
+// sketchDatabase resolves set names and wildcards over named sets, counting
+// the sketches it is asked for.
+type sketchDatabase struct {
+	sets     map[string]*sets.Set
+	sketches int
+}
+
+func (db *sketchDatabase) sketch(name string) (*sets.HyperLogLog, error) {
+	set, exists := db.sets[name]
+	if !exists {
+		return nil, fmt.Errorf("set not found: %s", name)
+	}
+	db.sketches++
+	return set.Sketch(), nil
+}
+
+func (db *sketchDatabase) resolve(name string) (*ResolvedSet, error) {
+	if IsWildcard(name) {
+		names := make([]string, 0)
+		for candidate := range db.sets {
+			if strings.HasPrefix(candidate, strings.TrimSuffix(name, "*")) {
+				names = append(names, candidate)
+			}
+		}
+		return &ResolvedSet{Name: name, Names: names}, nil
+	}
+	set, exists := db.sets[name]
+	if !exists {
+		return nil, fmt.Errorf("set not found: %s", name)
+	}
+	return &ResolvedSet{Name: name, Items: set}, nil
+}
+
+func TestEstimateScalar(t *testing.T) {
+	db := &sketchDatabase{sets: map[string]*sets.Set{
+		"a": span(0, 100000),
+		"b": span(50000, 150000),
+		"c": span(90000, 100000),
+	}}
+	a, b, c := &Set{Name: "a"}, &Set{Name: "b"}, &Set{Name: "c"}
+	binary := func(operator lexer.TokenType, lhs Node, rhs Node) Node {
+		return &BinaryExpr{Operator: operator, LHS: lhs, RHS: rhs}
+	}
+
+	tests := []struct {
+		name  string
+		arg   Node
+		exact *sets.Set
+	}{
+		{"a", a, db.sets["a"]},
+		{"a | b", binary(lexer.UNION, a, b), sets.Union(db.sets["a"], db.sets["b"])},
+		{"a & b", binary(lexer.INTERSECTION, a, b), sets.Intersection(db.sets["a"], db.sets["b"])},
+		{"a - b", binary(lexer.DIFFERENCE, a, b), sets.Difference(db.sets["a"], db.sets["b"])},
+		{"b - a", binary(lexer.DIFFERENCE, b, a), sets.Difference(db.sets["b"], db.sets["a"])},
+		{"a ^ b", binary(lexer.SYMMETRIC_DIFFERENCE, a, b), sets.SymmetricDifference(db.sets["a"], db.sets["b"])},
+		{"a & b - c", binary(lexer.DIFFERENCE, binary(lexer.INTERSECTION, a, b), c),
+			sets.Difference(sets.Intersection(db.sets["a"], db.sets["b"]), db.sets["c"])},
+		{"a - a", binary(lexer.DIFFERENCE, a, a), sets.NewSet()},
+		{"a & {'x'}", binary(lexer.INTERSECTION, a, &Set{Node: []Node{&Item{Value: sets.NewString("x")}}}), sets.NewSet()},
+	}
+
+	for _, test := range tests {
+		db.sketches = 0
+		call := CallExpr{Function: "approx_count", Arg: test.arg}
+		estimate, err := call.EstimateScalar(db.sketch, db.resolve)
+		if err != nil {
+			t.Errorf("approx_count(%s): %v", test.name, err)
+			continue
+		}
+
+		// errors add up from every region of the operands, allow 5% of
+		// the union of a and b
+		exact := float64(test.exact.Length())
+		if math.Abs(estimate-exact) > 0.05*150000 {
+			t.Errorf("approx_count(%s) = %.0f, want %.0f", test.name, estimate, exact)
+		}
+		if db.sketches > 3 {
+			t.Errorf("approx_count(%s): fetched %d sketches", test.name, db.sketches)
+		}
+	}
+}
+
+func TestEstimateScalarOperands(t *testing.T) {
+	db := &sketchDatabase{sets: make(map[string]*sets.Set)}
+	for i := 0; i < maxSketchOperands+1; i++ {
+		db.sets[fmt.Sprintf("team:%d", i)] = span(int64(i), int64(i)+10)
+	}
+	named := func(count int) []Node {
+		ret := make([]Node, 0, count)
+		for i := 0; i < count; i++ {
+			ret = append(ret, &Set{Name: fmt.Sprintf("team:%d", i)})
+		}
+		return ret
+	}
+
+	tests := []struct {
+		name  string
+		arg   Node
+		valid bool
+	}{
+		{"team:*", &Wildcard{Pattern: "team:*", Operator: lexer.UNION}, false},
+		{"team:0 | ... | team:7", &NaryExpr{Operator: lexer.UNION, Operands: named(maxSketchOperands)}, true},
+		{"team:0 | ... | team:8", &NaryExpr{Operator: lexer.UNION, Operands: named(maxSketchOperands + 1)}, false},
+		{"team:0 | ... | team:7 | team:0", &NaryExpr{Operator: lexer.UNION,
+			Operands: append(named(maxSketchOperands), &Set{Name: "team:0"})}, true},
+		{"team:0 | ... | team:7 | {1}", &NaryExpr{Operator: lexer.UNION,
+			Operands: append(named(maxSketchOperands), &Set{Node: []Node{&Item{Value: sets.NewInteger(1)}}})}, false},
+		{"team:0 & team:*", &BinaryExpr{Operator: lexer.INTERSECTION,
+			LHS: &Set{Name: "team:0"}, RHS: &Wildcard{Pattern: "team:*", Operator: lexer.UNION}}, false},
+	}
+
+	for _, test := range tests {
+		db.sketches = 0
+		call := CallExpr{Function: "approx_count", Arg: test.arg}
+		_, err := call.EstimateScalar(db.sketch, db.resolve)
+		if test.valid && err != nil {
+			t.Errorf("approx_count(%s): %v", test.name, err)
+		}
+		if !test.valid {
+			if err == nil || !strings.Contains(err.Error(), "too many sets") {
+				t.Errorf("approx_count(%s): got %v, want too many sets", test.name, err)
+			}
+			// the limit is enforced before any sketch is fetched
+			if db.sketches != 0 {
+				t.Errorf("approx_count(%s): fetched %d sketches", test.name, db.sketches)
+			}
+		}
+	}
+}
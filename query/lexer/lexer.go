@@ -18,8 +18,13 @@ package lexer
 
 import (
 	"bufio"
+	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 type TokenType int
@@ -32,27 +37,67 @@ const (
 
 	SET
 	ITEM
+	STRING
+	BOOLEAN
+	FUNCTION
 
 	ASSIGN
+	ADD_ASSIGN    // +=
+	REMOVE_ASSIGN // -=
 
 	UNION                // |
 	INTERSECTION         // &
 	DIFFERENCE           // -
 	SYMMETRIC_DIFFERENCE // ^
 
+	DEREFERENCE // *
+
 	SET_OPEN
 	SET_CLOSE
+
+	GROUP_OPEN
+	GROUP_CLOSE
+
+	SUBSET          // <=
+	PROPER_SUBSET   // <
+	SUPERSET        // >=
+	PROPER_SUPERSET // >
+	EQUAL           // ==
+	NOT_EQUAL       // !=
+	DISJOINT        // !&
+
+	RANGE // ..
+
+	GLOB   // ~
+	REGEX  // =~
+	PREFIX // ^=
+	AND    // &&
+	OR     // ||
+
+	DROP
+	RENAME
+	TO
+	CASCADE
+	MEMBERSHIP
+	EXPLAIN
+	IN
+	AS
 )
 
 var tokens = []string{
-	EOF:     "EOF",
-	ILLEGAL: "ILLEGAL",
-	SET:     "SET",
-	ITEM:    "ITEM",
+	EOF:      "EOF",
+	ILLEGAL:  "ILLEGAL",
+	SET:      "SET",
+	ITEM:     "ITEM",
+	STRING:   "STRING",
+	BOOLEAN:  "BOOLEAN",
+	FUNCTION: "FUNCTION",
 
 	COMMA: ",",
 
-	ASSIGN: "=",
+	ASSIGN:        "=",
+	ADD_ASSIGN:    "+=",
+	REMOVE_ASSIGN: "-=",
 
 	// Infix ops
 
@@ -61,14 +106,69 @@ var tokens = []string{
 	DIFFERENCE:           "-",
 	SYMMETRIC_DIFFERENCE: "^",
 
+	// Prefix ops
+
+	DEREFERENCE: "*",
+
 	SET_OPEN:  "{",
 	SET_CLOSE: "}",
+
+	GROUP_OPEN:  "(",
+	GROUP_CLOSE: ")",
+
+	// Predicates
+
+	SUBSET:          "<=",
+	PROPER_SUBSET:   "<",
+	SUPERSET:        ">=",
+	PROPER_SUPERSET: ">",
+	EQUAL:           "==",
+	NOT_EQUAL:       "!=",
+	DISJOINT:        "!&",
+
+	RANGE: "..",
+
+	GLOB:   "~",
+	REGEX:  "=~",
+	PREFIX: "^=",
+	AND:    "&&",
+	OR:     "||",
+
+	// Keywords
+
+	DROP:       "DROP",
+	RENAME:     "RENAME",
+	TO:         "TO",
+	CASCADE:    "CASCADE",
+	MEMBERSHIP: "MEMBERSHIP",
+	EXPLAIN:    "EXPLAIN",
+	IN:         "IN",
+	AS:         "AS",
+}
+
+// keywords are matched case-insensitively, they are contextual: the parser
+// reads them as set names wherever a set name is expected, see IsKeyword.
+var keywords = map[string]TokenType{
+	"DROP":       DROP,
+	"RENAME":     RENAME,
+	"TO":         TO,
+	"CASCADE":    CASCADE,
+	"MEMBERSHIP": MEMBERSHIP,
+	"EXPLAIN":    EXPLAIN,
+	"IN":         IN,
+	"AS":         AS,
 }
 
 func (t TokenType) String() string {
 	return tokens[t]
 }
 
+// IsKeyword returns true if a token is a keyword, whose value is then the
+// keyword as written.
+func (t TokenType) IsKeyword() bool {
+	return t >= DROP && t <= AS
+}
+
 type Position struct {
 	line   int
 	column int
@@ -111,6 +211,10 @@ func tokenFromLexer(tokenType TokenType, tokenPosition Position, tokenValue stri
 type Lexer struct {
 	reader *bufio.Reader
 	pos    Position
+	err    error
+
+	// legacy lexes true and false as set names
+	legacy bool
 }
 
 func NewLexer(reader io.Reader) *Lexer {
@@ -120,6 +224,14 @@ func NewLexer(reader io.Reader) *Lexer {
 	}
 }
 
+// NewLegacyLexer returns a lexer for patterns persisted before booleans were
+// introduced, in which true and false are set names.
+func NewLegacyLexer(reader io.Reader) *Lexer {
+	l := NewLexer(reader)
+	l.legacy = true
+	return l
+}
+
 func (l *Lexer) Lex() Token {
 
 	// keep looping until we return a token
@@ -130,9 +242,10 @@ func (l *Lexer) Lex() Token {
 				return tokenFromLexer(EOF, l.pos, "")
 			}
 
-			// at this point there isn't much we can do, and the compiler
-			// should just return the raw error to the user
-			panic(err)
+			// at this point there isn't much we can do, the error is kept
+			// so the parser can return the raw error to the user
+			l.err = err
+			return tokenFromLexer(ILLEGAL, l.pos, err.Error())
 		}
 		l.pos.column++
 
@@ -144,27 +257,108 @@ func (l *Lexer) Lex() Token {
 			return tokenFromLexer(COMMA, l.pos, ",")
 
 		case '|':
+			startPos := l.pos
+			if l.accept('|') {
+				return tokenFromLexer(OR, startPos, "||")
+			}
 			return tokenFromLexer(UNION, l.pos, "|")
 		case '&':
+			startPos := l.pos
+			if l.accept('&') {
+				return tokenFromLexer(AND, startPos, "&&")
+			}
 			return tokenFromLexer(INTERSECTION, l.pos, "&")
 		case '-':
+			startPos := l.pos
+			if l.accept('=') {
+				return tokenFromLexer(REMOVE_ASSIGN, startPos, "-=")
+			}
 			return tokenFromLexer(DIFFERENCE, l.pos, "-")
+		case '+':
+			startPos := l.pos
+			if l.accept('=') {
+				return tokenFromLexer(ADD_ASSIGN, startPos, "+=")
+			}
+			return tokenFromLexer(ILLEGAL, l.pos, string(r))
 		case '^':
+			startPos := l.pos
+			if l.accept('=') {
+				return tokenFromLexer(PREFIX, startPos, "^=")
+			}
 			return tokenFromLexer(SYMMETRIC_DIFFERENCE, l.pos, "^")
+		case '~':
+			return tokenFromLexer(GLOB, l.pos, "~")
+
+		case '*':
+			return tokenFromLexer(DEREFERENCE, l.pos, "*")
 
 		case '{':
-			return tokenFromLexer(SET_OPEN, l.pos, "(")
+			return tokenFromLexer(SET_OPEN, l.pos, "{")
 		case '}':
-			return tokenFromLexer(SET_CLOSE, l.pos, ")")
+			return tokenFromLexer(SET_CLOSE, l.pos, "}")
+
+		case '(':
+			return tokenFromLexer(GROUP_OPEN, l.pos, "(")
+		case ')':
+			return tokenFromLexer(GROUP_CLOSE, l.pos, ")")
 
 		case '=':
+			startPos := l.pos
+			if l.accept('=') {
+				return tokenFromLexer(EQUAL, startPos, "==")
+			} else if l.accept('~') {
+				return tokenFromLexer(REGEX, startPos, "=~")
+			}
 			return tokenFromLexer(ASSIGN, l.pos, "=")
 
-		case '\'':
+		case '<':
 			startPos := l.pos
-			l.backup()
-			lit := l.lexItem()
-			return tokenFromLexer(ITEM, startPos, lit)
+			if l.accept('=') {
+				return tokenFromLexer(SUBSET, startPos, "<=")
+			}
+			return tokenFromLexer(PROPER_SUBSET, l.pos, "<")
+		case '>':
+			startPos := l.pos
+			if l.accept('=') {
+				return tokenFromLexer(SUPERSET, startPos, ">=")
+			}
+			return tokenFromLexer(PROPER_SUPERSET, l.pos, ">")
+		case '!':
+			startPos := l.pos
+			if l.accept('=') {
+				return tokenFromLexer(NOT_EQUAL, startPos, "!=")
+			} else if l.accept('&') {
+				return tokenFromLexer(DISJOINT, startPos, "!&")
+			}
+			return tokenFromLexer(ILLEGAL, l.pos, string(r))
+
+		case '.':
+			startPos := l.pos
+			if l.accept('.') {
+				return tokenFromLexer(RANGE, startPos, "..")
+			}
+			return tokenFromLexer(ILLEGAL, l.pos, string(r))
+
+		case '\'', '"':
+			startPos := l.pos
+			lit, err := l.lexString(r)
+			if err != nil {
+				return tokenFromLexer(ILLEGAL, startPos, err.Error())
+			}
+			return tokenFromLexer(STRING, startPos, lit)
+
+		case '`':
+			// a quoted set name is never a keyword, a boolean nor a
+			// function, which allows any name to be referenced
+			startPos := l.pos
+			lit, err := l.lexString(r)
+			if err != nil {
+				return tokenFromLexer(ILLEGAL, startPos, err.Error())
+			}
+			if lit == "" {
+				return tokenFromLexer(ILLEGAL, startPos, "empty set name")
+			}
+			return tokenFromLexer(SET, startPos, lit)
 
 		default:
 			if unicode.IsSpace(r) {
@@ -174,12 +368,24 @@ func (l *Lexer) Lex() Token {
 				startPos := l.pos
 				l.backup()
 				lit := l.lexIdent()
+				if keyword, exists := keywords[strings.ToUpper(lit)]; exists {
+					return tokenFromLexer(keyword, startPos, lit)
+				}
+				if isBoolean(lit) && !l.legacy {
+					return tokenFromLexer(BOOLEAN, startPos, lit)
+				}
+				// a name immediately followed by '(' is a function call,
+				// the parenthesis is left for the parser to consume
+				if l.accept('(') {
+					l.backup()
+					return tokenFromLexer(FUNCTION, startPos, lit)
+				}
 				return tokenFromLexer(SET, startPos, lit)
 			} else if unicode.IsDigit(r) {
-				// backup and let lexIdent rescan the beginning of the ident
+				// backup and let lexNumber rescan the beginning of the item
 				startPos := l.pos
 				l.backup()
-				lit := l.lexIdent()
+				lit := l.lexNumber()
 				return tokenFromLexer(ITEM, startPos, lit)
 			} else {
 				return tokenFromLexer(ILLEGAL, l.pos, string(r))
@@ -193,27 +399,101 @@ func (l *Lexer) resetPosition() {
 	l.pos.column = 0
 }
 
+// Err returns the first read error encountered by the lexer, if any.
+func (l *Lexer) Err() error {
+	return l.err
+}
+
 func (l *Lexer) backup() {
 	if err := l.reader.UnreadRune(); err != nil {
-		panic(err)
+		if l.err == nil {
+			l.err = err
+		}
+		return
 	}
 
 	l.pos.column--
 }
 
+// accept consumes the next rune if it matches expected, which allows
+// scanning two-character operators such as <= or !=.
+func (l *Lexer) accept(expected rune) bool {
+	r, _, err := l.reader.ReadRune()
+	if err != nil {
+		return false
+	}
+	l.pos.column++
+	if r != expected {
+		l.backup()
+		return false
+	}
+	return true
+}
+
+// isBoolean returns true if an identifier is a boolean, unlike keywords
+// booleans are lowercase so that other spellings remain set names.
+func isBoolean(lit string) bool {
+	return lit == "true" || lit == "false"
+}
+
+func isIdentRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == ':' || r == '*' || r == '?'
+}
+
+// QuoteIdent returns a set name as written in a query: as is if it is
+// scanned back as a set name, between backquotes otherwise, such as for
+// names starting with a digit or matching a boolean. Names matching a
+// keyword are quoted as well, so that they are never mistaken for one.
+func QuoteIdent(name string) string {
+	plain := name != "" && !isBoolean(name)
+	if _, exists := keywords[strings.ToUpper(name)]; exists {
+		plain = false
+	}
+	for i, r := range name {
+		if (i == 0 && !unicode.IsLetter(r)) || !isIdentRune(r) {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return name
+	}
+
+	var buf strings.Builder
+	buf.WriteByte('`')
+	for _, r := range name {
+		switch {
+		case r == '`' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case unicode.IsPrint(r):
+			buf.WriteRune(r)
+		default:
+			for _, u := range utf16.Encode([]rune{r}) {
+				fmt.Fprintf(&buf, "\\u%04x", u)
+			}
+		}
+	}
+	buf.WriteByte('`')
+	return buf.String()
+}
+
+// lexIdent scans an identifier, set names may also contain the wildcards *
+// and ? past their first character to reference all the sets matching them.
 func (l *Lexer) lexIdent() string {
 	var lit string
 	for {
 		r, _, err := l.reader.ReadRune()
 		if err != nil {
-			if err == io.EOF {
-				// at the end of the identifier
-				return lit
+			if err != io.EOF {
+				l.err = err
 			}
+			// at the end of the identifier
+			return lit
 		}
 
 		l.pos.column++
-		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == ':' {
+		if isIdentRune(r) {
 			lit = lit + string(r)
 		} else {
 			// scanned something not in the identifier
@@ -223,31 +503,156 @@ func (l *Lexer) lexIdent() string {
 	}
 }
 
-func (l *Lexer) lexItem() string {
+// lexNumber scans an item starting with a digit: an integer, a float with a
+// fractional part and or an exponent, or a bare item made of letters, digits
+// and colons. A dot is only part of a number if a digit follows, so that 1..5
+// is scanned as a range.
+func (l *Lexer) lexNumber() string {
 	var lit string
-	r, _, err := l.reader.ReadRune()
-	if err != nil || (r != '"' && r != '\'') {
-		// not a string
-		return ""
+	for {
+		// runes are peeked rather than read and unread as a dot is only
+		// consumed once the rune following it is known
+		next, _ := l.reader.Peek(2)
+		if len(next) == 0 {
+			return lit
+		}
+
+		r := rune(next[0])
+		switch {
+		case r >= utf8.RuneSelf:
+			// non-ASCII letters are part of bare items
+			r, _, _ = l.reader.ReadRune()
+			l.reader.UnreadRune()
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				return lit
+			}
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == ':':
+		case r == '.' && isDigits(lit) && len(next) == 2 && next[1] >= '0' && next[1] <= '9':
+		case (r == '+' || r == '-') && isExponent(lit):
+		default:
+			return lit
+		}
+
+		r, _, err := l.reader.ReadRune()
+		if err != nil {
+			l.err = err
+			return lit
+		}
+		l.pos.column++
+		lit = lit + string(r)
+	}
+}
+
+func isDigits(lit string) bool {
+	for _, r := range lit {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return lit != ""
+}
+
+// isExponent returns true if lit is a number followed by the start of an
+// exponent, which can be signed.
+func isExponent(lit string) bool {
+	mantissa := strings.TrimSuffix(strings.TrimSuffix(lit, "e"), "E")
+	if mantissa == lit {
+		return false
 	}
-	lit = lit + string(r)
+	integer, fraction, found := strings.Cut(mantissa, ".")
+	return isDigits(integer) && (!found || isDigits(fraction))
+}
 
+// lexString scans a string or a quoted set name up to the closing quote,
+// which has to match the opening one, and returns its content with escape
+// sequences decoded.
+func (l *Lexer) lexString(quote rune) (string, error) {
+	var lit strings.Builder
 	for {
-		r, _, err := l.reader.ReadRune()
+		r, err := l.read()
 		if err != nil {
-			if err == io.EOF {
-				// at the end of the string
-				return lit
+			return "", fmt.Errorf("unterminated string")
+		}
+
+		switch r {
+		case quote:
+			return lit.String(), nil
+		case '\\':
+			r, err := l.lexEscape()
+			if err != nil {
+				return "", err
 			}
+			lit.WriteRune(r)
+		default:
+			lit.WriteRune(r)
 		}
+	}
+}
 
-		l.pos.column++
-		if r != '"' && r != '\'' {
-			lit = lit + string(r)
-		} else {
-			lit = lit + string(r)
-			// scanned the end quote of the string
-			return lit
+// lexEscape decodes the escape sequence following a backslash: \', \", \`,
+// \\ and \u followed by four hexadecimal digits. Characters outside of the
+// Basic Multilingual Plane are written as a \u surrogate pair.
+func (l *Lexer) lexEscape() (rune, error) {
+	r, err := l.read()
+	if err != nil {
+		return 0, fmt.Errorf("unterminated string")
+	}
+
+	switch r {
+	case '\'', '"', '`', '\\':
+		return r, nil
+	case 'u':
+		r, err := l.lexCodePoint()
+		if err != nil {
+			return 0, err
+		}
+		if !utf16.IsSurrogate(r) {
+			return r, nil
 		}
+		if !l.accept('\\') || !l.accept('u') {
+			return 0, fmt.Errorf("invalid surrogate pair in string")
+		}
+		low, err := l.lexCodePoint()
+		if err != nil {
+			return 0, err
+		}
+		if r = utf16.DecodeRune(r, low); r == unicode.ReplacementChar {
+			return 0, fmt.Errorf("invalid surrogate pair in string")
+		}
+		return r, nil
+	default:
+		return 0, fmt.Errorf("invalid escape sequence in string: \\%c", r)
+	}
+}
+
+func (l *Lexer) lexCodePoint() (rune, error) {
+	var digits string
+	for i := 0; i < 4; i++ {
+		r, err := l.read()
+		if err != nil {
+			return 0, fmt.Errorf("unterminated string")
+		}
+		digits += string(r)
+	}
+	value, err := strconv.ParseUint(digits, 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid escape sequence in string: \\u%s", digits)
+	}
+	return rune(value), nil
+}
+
+// read consumes the next rune and keeps track of the position.
+func (l *Lexer) read() (rune, error) {
+	r, _, err := l.reader.ReadRune()
+	if err != nil {
+		if err != io.EOF {
+			l.err = err
+		}
+		return 0, err
+	}
+	l.pos.column++
+	if r == '\n' {
+		l.resetPosition()
 	}
+	return r, nil
 }
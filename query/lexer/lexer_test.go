@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package lexer
+
+import (
+	"strings"
+	"testing"
+)
+
+// lex returns the first token of input.
+func lex(input string) Token {
+	return NewLexer(strings.NewReader(input)).Lex()
+}
+
+func TestLexString(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`'grape'`, "grape"},
+		{`"grape"`, "grape"},
+		{`''`, ""},
+		{`'it\'s'`, "it's"},
+		{`"say \"hi\""`, `say "hi"`},
+		{`'"'`, `"`},
+		{`"'"`, `'`},
+		{`'back\\slash'`, `back\slash`},
+		{"'back\\`quote'", "back`quote"},
+		{`'café'`, "café"},
+		{`'caf\u00e9'`, "café"},
+		{`'\ud83d\ude00'`, "😀"},
+		{"'two\nlines'", "two\nlines"},
+	}
+
+	for _, test := range tests {
+		token := lex(test.input)
+		if token.Type() != STRING {
+			t.Errorf("%s: got %s (%s), want STRING", test.input, token.Type(), token.Value())
+		} else if token.Value() != test.want {
+			t.Errorf("%s: got %q, want %q", test.input, token.Value(), test.want)
+		}
+	}
+}
+
+func TestLexStringInvalid(t *testing.T) {
+	tests := []string{
+		`'grape`,
+		`'grape"`,
+		`'grape\'`,
+		`'\n'`,
+		`'\t'`,
+		`'\x41'`,
+		`'\u00'`,
+		`'\u00e'`,
+		`'\u00g9'`,
+		`'\u+0e9'`,
+		`'\ud83d'`,
+		`'\ud83dA'`,
+		`'\ud83dx'`,
+		`'\ude00\ud83d'`,
+		`'\`,
+	}
+
+	for _, input := range tests {
+		if token := lex(input); token.Type() != ILLEGAL {
+			t.Errorf("%s: got %s (%q), want ILLEGAL", input, token.Type(), token.Value())
+		}
+	}
+}
+
+func TestLexKeywords(t *testing.T) {
+	tests := []struct {
+		input     string
+		tokenType TokenType
+		value     string
+	}{
+		{"DROP", DROP, "DROP"},
+		{"drop", DROP, "drop"},
+		{"To", TO, "To"},
+		{"in", IN, "in"},
+		{"true", BOOLEAN, "true"},
+		{"false", BOOLEAN, "false"},
+		{"FALSE", SET, "FALSE"},
+		{"True", SET, "True"},
+		{"count(", FUNCTION, "count"},
+		{"dropped", SET, "dropped"},
+		{"team:*", SET, "team:*"},
+		{"`drop`", SET, "drop"},
+		{"`in`", SET, "in"},
+		{"`true`", SET, "true"},
+		{"`count`(", SET, "count"},
+		{"`my set`", SET, "my set"},
+		{"`42`", SET, "42"},
+		{"`a\\`b`", SET, "a`b"},
+		{"``", ILLEGAL, "empty set name"},
+		{"`drop", ILLEGAL, "unterminated string"},
+	}
+
+	for _, test := range tests {
+		token := lex(test.input)
+		if token.Type() != test.tokenType || token.Value() != test.value {
+			t.Errorf("%s: got %s (%q), want %s (%q)", test.input, token.Type(), token.Value(), test.tokenType, test.value)
+		}
+	}
+}
+
+func TestQuoteIdent(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"fruits", "fruits"},
+		{"team:web", "team:web"},
+		{"team:*", "team:*"},
+		{"snake_case2", "snake_case2"},
+		{"café", "café"},
+		{"to", "`to`"},
+		{"Explain", "`Explain`"},
+		{"true", "`true`"},
+		{"True", "True"},
+		{"42", "`42`"},
+		{"_a", "`_a`"},
+		{"my set", "`my set`"},
+		{"a`b", "`a\\`b`"},
+		{"a\\b", "`a\\\\b`"},
+		{"tab\t", "`tab\\u0009`"},
+	}
+
+	for _, test := range tests {
+		quoted := QuoteIdent(test.name)
+		if quoted != test.want {
+			t.Errorf("QuoteIdent(%q) = %s, want %s", test.name, quoted, test.want)
+		}
+
+		// the quoted name must be scanned back as the same set name
+		l := NewLexer(strings.NewReader(quoted))
+		token := l.Lex()
+		if token.Type() != SET || token.Value() != test.name {
+			t.Errorf("%s: got %s (%q), want SET (%q)", quoted, token.Type(), token.Value(), test.name)
+		}
+		if token := l.Lex(); token.Type() != EOF {
+			t.Errorf("%s: got %s (%q) past the name, want EOF", quoted, token.Type(), token.Value())
+		}
+	}
+}
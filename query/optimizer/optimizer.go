@@ -0,0 +1,362 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package optimizer
+
+import (
+	"sort"
+
+	"github.com/poolpOrg/go-setdb/query/ast"
+	"github.com/poolpOrg/go-setdb/query/lexer"
+)
+
+// Optimizer rewrites a statement into an equivalent one that is cheaper to
+// evaluate. The statement is never modified in place, so it can still be
+// persisted as written once the optimized one has been evaluated.
+//
+// References to sets may be pruned from the rewritten statement, callers
+// must check that the sets referenced exist before optimizing so that a
+// query fails the same way whether it is optimized or not.
+type Optimizer struct {
+	estimate func(string) (int64, bool)
+}
+
+// NewOptimizer returns an optimizer relying on estimate, which may be nil,
+// to know the cardinality of named sets when ordering intersections.
+func NewOptimizer(estimate func(string) (int64, bool)) *Optimizer {
+	return &Optimizer{
+		estimate: estimate,
+	}
+}
+
+func (o *Optimizer) Optimize(statement ast.Statement) ast.Statement {
+	switch node := statement.(type) {
+	case *ast.ComparisonExpr:
+		return &ast.ComparisonExpr{
+			Operator: node.Operator,
+			LHS:      o.optimize(node.LHS),
+			RHS:      o.optimize(node.RHS),
+		}
+	case *ast.CallExpr:
+		return &ast.CallExpr{
+			Function: node.Function,
+			Arg:      o.optimize(node.Arg),
+		}
+	case *ast.AssignExpr:
+		return &ast.AssignExpr{
+			Name: node.Name,
+			Expr: o.optimize(node.Expr),
+		}
+	case ast.Node:
+		return o.optimize(node)
+	default:
+		return statement
+	}
+}
+
+func (o *Optimizer) optimize(node ast.Node) ast.Node {
+	switch node := node.(type) {
+	case *ast.BinaryExpr:
+		return o.binary(node.Operator, o.optimize(node.LHS), o.optimize(node.RHS))
+
+	case *ast.NaryExpr:
+		operands := make([]ast.Node, 0, len(node.Operands))
+		for _, operand := range node.Operands {
+			operands = append(operands, o.optimize(operand))
+		}
+		return o.nary(node.Operator, operands)
+
+	case *ast.Set:
+		if node.Name != "" {
+			return node
+		}
+		// an inline set is the union of its elements
+		operands := make([]ast.Node, 0, len(node.Node))
+		for _, item := range node.Node {
+			operands = append(operands, o.optimize(item))
+		}
+		return o.nary(lexer.UNION, operands)
+
+	case *ast.Dereference:
+		return &ast.Dereference{Expr: o.optimize(node.Expr)}
+
+	case *ast.TypeAssertion:
+		return &ast.TypeAssertion{Expr: o.optimize(node.Expr), Type: node.Type}
+
+	case *ast.Comprehension:
+		source := o.optimize(node.Source)
+		if isEmpty(source) {
+			return source
+		}
+		comprehension := &ast.Comprehension{Var: node.Var, Source: source, Predicate: node.Predicate}
+		if isConstant(source) {
+			return fold(comprehension)
+		}
+		return comprehension
+
+	default:
+		return node
+	}
+}
+
+func (o *Optimizer) binary(operator lexer.TokenType, lhs ast.Node, rhs ast.Node) ast.Node {
+	switch operator {
+	case lexer.UNION, lexer.INTERSECTION:
+		return o.nary(operator, []ast.Node{lhs, rhs})
+
+	case lexer.DIFFERENCE:
+		switch {
+		case isEmpty(lhs), isEmpty(rhs):
+			return lhs
+		case sameAs(lhs, rhs):
+			return empty()
+		}
+
+	case lexer.SYMMETRIC_DIFFERENCE:
+		switch {
+		case isEmpty(lhs):
+			return rhs
+		case isEmpty(rhs):
+			return lhs
+		case sameAs(lhs, rhs):
+			return empty()
+		}
+	}
+
+	node := &ast.BinaryExpr{Operator: operator, LHS: lhs, RHS: rhs}
+	if isConstant(lhs) && isConstant(rhs) {
+		return fold(node)
+	}
+	return node
+}
+
+// nary flattens operands of the same associative operator into a single
+// operation, folding the constant ones and dropping the duplicate ones.
+func (o *Optimizer) nary(operator lexer.TokenType, operands []ast.Node) ast.Node {
+	flattened := make([]ast.Node, 0, len(operands))
+	for _, operand := range operands {
+		if nested, ok := operand.(*ast.NaryExpr); ok && nested.Operator == operator {
+			flattened = append(flattened, nested.Operands...)
+		} else {
+			flattened = append(flattened, operand)
+		}
+	}
+
+	constants := make([]ast.Node, 0)
+	kept := make([]ast.Node, 0, len(flattened))
+	seen := make(map[string]struct{})
+	for _, operand := range flattened {
+		if isConstant(operand) {
+			constants = append(constants, operand)
+			continue
+		}
+		query := operand.ToQuery()
+		if _, exists := seen[query]; !exists {
+			seen[query] = struct{}{}
+			kept = append(kept, operand)
+		}
+	}
+
+	// a range on its own gains nothing from being enumerated, and can be
+	// used as a filter if kept as is
+	if len(constants) == 1 {
+		if _, ok := constants[0].(*ast.Range); ok {
+			kept = append(constants, kept...)
+			constants = nil
+		}
+	}
+
+	if len(constants) != 0 {
+		var folded ast.Node
+		if operator == lexer.UNION {
+			// an inline set adds literal items to a single set
+			folded = fold(&ast.Set{Node: constants})
+		} else {
+			folded = fold(&ast.NaryExpr{Operator: operator, Operands: constants})
+		}
+		if !isEmpty(folded) {
+			kept = append([]ast.Node{folded}, kept...)
+		} else if operator == lexer.INTERSECTION {
+			return folded
+		}
+	}
+
+	switch len(kept) {
+	case 0:
+		return empty()
+	case 1:
+		return kept[0]
+	}
+
+	if operator == lexer.INTERSECTION {
+		o.order(kept)
+	}
+	return &ast.NaryExpr{Operator: operator, Operands: kept}
+}
+
+// order sorts the operands of an intersection by increasing estimated
+// cardinality, operands of unknown cardinality coming last, so that small
+// sets are evaluated first and an empty one stops the evaluation early.
+func (o *Optimizer) order(operands []ast.Node) {
+	type estimate struct {
+		cardinality int64
+		known       bool
+	}
+	estimates := make(map[ast.Node]estimate, len(operands))
+	for _, operand := range operands {
+		cardinality, known := o.cardinality(operand)
+		estimates[operand] = estimate{cardinality, known}
+	}
+
+	sort.SliceStable(operands, func(i, j int) bool {
+		a, b := estimates[operands[i]], estimates[operands[j]]
+		if a.known != b.known {
+			return a.known
+		}
+		return a.cardinality < b.cardinality
+	})
+}
+
+func (o *Optimizer) cardinality(node ast.Node) (int64, bool) {
+	switch node := node.(type) {
+	case *ast.Item:
+		return 1, true
+
+	case *ast.Range:
+		return node.Length()
+
+	case *ast.Set:
+		if node.Name == "" && isConstant(node) {
+			return int64(len(node.Node)), true
+		}
+		if node.Name != "" && o.estimate != nil {
+			return o.estimate(node.Name)
+		}
+
+	case *ast.Dereference:
+		return o.cardinality(node.Expr)
+
+	case *ast.TypeAssertion:
+		return o.cardinality(node.Expr)
+
+	case *ast.Comprehension:
+		return o.cardinality(node.Source)
+
+	case *ast.BinaryExpr:
+		return o.combine(node.Operator, []ast.Node{node.LHS, node.RHS})
+
+	case *ast.NaryExpr:
+		return o.combine(node.Operator, node.Operands)
+	}
+	return 0, false
+}
+
+// combine estimates the upper bound of the cardinality of an operation.
+func (o *Optimizer) combine(operator lexer.TokenType, operands []ast.Node) (int64, bool) {
+	switch operator {
+	case lexer.INTERSECTION:
+		var ret int64
+		known := false
+		for _, operand := range operands {
+			if cardinality, ok := o.cardinality(operand); ok && (!known || cardinality < ret) {
+				ret, known = cardinality, true
+			}
+		}
+		return ret, known
+
+	case lexer.DIFFERENCE:
+		return o.cardinality(operands[0])
+
+	default:
+		var ret int64
+		for _, operand := range operands {
+			cardinality, ok := o.cardinality(operand)
+			if !ok {
+				return 0, false
+			}
+			ret += cardinality
+		}
+		return ret, true
+	}
+}
+
+// foldLimit is the largest range folded into literal items.
+const foldLimit = 1024
+
+// isConstant reports whether a node only holds literal items, which makes
+// it possible to evaluate it without resolving any set.
+func isConstant(node ast.Node) bool {
+	switch node := node.(type) {
+	case *ast.Item:
+		return true
+	case *ast.Range:
+		// large ranges are kept as is so they can be used as filters
+		length, ok := node.Length()
+		return ok && length <= foldLimit
+	case *ast.Set:
+		if node.Name != "" {
+			return false
+		}
+		for _, item := range node.Node {
+			if !isConstant(item) {
+				return false
+			}
+		}
+		return true
+	case *ast.BinaryExpr:
+		return isConstant(node.LHS) && isConstant(node.RHS)
+	case *ast.NaryExpr:
+		for _, operand := range node.Operands {
+			if !isConstant(operand) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// fold evaluates a constant node into an inline set of sorted items.
+func fold(node ast.Node) ast.Node {
+	resultset, err := node.Evaluate(nil)
+	if err != nil {
+		return node
+	}
+
+	items := resultset.ItemsList()
+
+	nodes := make([]ast.Node, 0, len(items))
+	for _, item := range items {
+		nodes = append(nodes, &ast.Item{Value: item})
+	}
+	return &ast.Set{Node: nodes}
+}
+
+func empty() ast.Node {
+	return &ast.Set{Node: []ast.Node{}}
+}
+
+func isEmpty(node ast.Node) bool {
+	set, ok := node.(*ast.Set)
+	return ok && set.Name == "" && len(set.Node) == 0
+}
+
+// sameAs reports whether two nodes are written the same way, evaluation
+// being deterministic they then evaluate to the same items.
+func sameAs(lhs ast.Node, rhs ast.Node) bool {
+	return lhs.ToQuery() == rhs.ToQuery()
+}
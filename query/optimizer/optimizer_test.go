@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package optimizer
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/poolpOrg/go-setdb/query/ast"
+	"github.com/poolpOrg/go-setdb/query/lexer"
+	"github.com/poolpOrg/go-setdb/query/parser"
+	"github.com/poolpOrg/go-setdb/sets"
+)
+
+// span returns a set of the integers from lo to hi excluded.
+func span(lo int64, hi int64) *sets.Set {
+	set := sets.NewSet()
+	for i := lo; i < hi; i++ {
+		set.Add(sets.NewInteger(i))
+	}
+	return set
+}
+
+// named are the sets the queries below reference, d has no known
+// cardinality.
+var named = map[string]*sets.Set{
+	"a": span(0, 100),
+	"b": span(90, 100),
+	"c": span(0, 1000),
+	"d": span(50, 60),
+}
+
+func estimate(name string) (int64, bool) {
+	if name == "d" {
+		return 0, false
+	}
+	return int64(named[name].Length()), true
+}
+
+func resolve(name string) (*ast.ResolvedSet, error) {
+	set, exists := named[name]
+	if !exists {
+		return nil, fmt.Errorf("set not found: %s", name)
+	}
+	return &ast.ResolvedSet{Name: name, Items: set}, nil
+}
+
+func parse(t *testing.T, query string) ast.Statement {
+	t.Helper()
+	statement, err := parser.NewParser(lexer.NewLexer(strings.NewReader(query))).Parse()
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return statement
+}
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		// operands of the same associative operator are flattened
+		{"a | b | c", "a|b|c"},
+		{"a | (b | c)", "a|b|c"},
+		{"(a - b) | (c | d)", "(a-b)|c|d"},
+
+		// duplicate operands are dropped
+		{"a | b | a", "a|b"},
+		{"a & a", "a"},
+		{"(a | b) & (b | a) & (a | b)", "(a|b)&(b|a)"},
+
+		// constant operands are folded into a single inline set
+		{"a | {1} | {2, 3}", "{1,2,3}|a"},
+		{"{1, 2} & a & {2, 3}", "{2}&a"},
+		{"{1, 2} - {2}", "{1}"},
+		{"{1, 2} ^ {2, 3}", "{1,3}"},
+		{"{i in {1, 2, 3} | i > 1}", "{2,3}"},
+		{"{3..5} | {1}", "{1,3,4,5}"},
+
+		// a range on its own is kept, and so are ranges too large to fold
+		{"{1..1024}", "1..1024"},
+		{"a & {1..1025}", "a&1..1025"},
+		{"{1..1025} | {2000}", "{2000}|1..1025"},
+
+		// empty and identity rules
+		{"a - a", "{}"},
+		{"(a | b) - (a | b)", "{}"},
+		{"a & {}", "{}"},
+		{"{} - a", "{}"},
+		{"a - {}", "a"},
+		{"a | {}", "a"},
+		{"{} ^ a", "a"},
+		{"a ^ {}", "a"},
+		{"a ^ a", "{}"},
+		{"{i in {} | i > 1}", "{}"},
+		{"{i in a - a | i > 1}", "{}"},
+
+		// intersections start with the smallest operands, those of
+		// unknown cardinality last
+		{"c & a & b", "b&a&c"},
+		{"d & c & b", "b&c&d"},
+		{"c & (a | b)", "(a|b)&c"},
+		{"c & a & {1..1000}", "a&1..1000&c"},
+
+		// statements other than expressions have their operands optimized
+		{"x = a | a", "x = a"},
+		{"count(a & a)", "count(a)"},
+		{"c & b == b & c", "b&c==b&c"},
+	}
+
+	optimizer := NewOptimizer(estimate)
+	for _, test := range tests {
+		statement := parse(t, test.query)
+		before := statement.ToQuery()
+		if got := optimizer.Optimize(statement).ToQuery(); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.query, got, test.want)
+		}
+		if statement.ToQuery() != before {
+			t.Errorf("%s: modified in place", test.query)
+		}
+	}
+}
+
+func TestOptimizeFoldLimit(t *testing.T) {
+	tests := []struct {
+		query  string
+		folded bool
+	}{
+		{fmt.Sprintf("{1..%d} | {0}", foldLimit), true},
+		{fmt.Sprintf("{1..%d} | {0}", foldLimit+1), false},
+		{fmt.Sprintf("{'a'..'z'} | {1..%d}", foldLimit), true},
+	}
+
+	for _, test := range tests {
+		optimized := NewOptimizer(nil).Optimize(parse(t, test.query))
+		set, folded := optimized.(*ast.Set)
+		if folded != test.folded {
+			t.Errorf("%s: folded %v, want %v", test.query, folded, test.folded)
+			continue
+		}
+		if folded && set.Name != "" {
+			t.Errorf("%s: got set %s", test.query, set.Name)
+		}
+	}
+}
+
+// TestOptimizeEvaluate checks that optimized expressions evaluate to the
+// same items as they would as written.
+func TestOptimizeEvaluate(t *testing.T) {
+	tests := []string{
+		"a | b | c",
+		"c & a & b",
+		"d & c & b",
+		"a - b - d",
+		"a ^ b ^ d",
+		"(a | b) - (a | b)",
+		"a & {}",
+		"{} - a",
+		"{} ^ a",
+		"a & {1..1025}",
+		"c & {95..2000} & b",
+		"a | {1} | {'x', true}",
+		"{1, 2} & a & {2, 3}",
+		"{i in a & c | i > 95}",
+		"{i in {1, 2, 3} | i > 1} | d",
+		"(a - b) & (c ^ d) | b",
+		"(a | b) & (b | a) & (a | b)",
+	}
+
+	optimizer := NewOptimizer(estimate)
+	for _, query := range tests {
+		node := parse(t, query).(ast.Node)
+		want, err := node.Evaluate(resolve)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		got, err := optimizer.Optimize(node).(ast.Node).Evaluate(resolve)
+		if err != nil {
+			t.Fatalf("%s optimized: %v", query, err)
+		}
+		if fmt.Sprint(got.ItemsList()) != fmt.Sprint(want.ItemsList()) {
+			t.Errorf("%s: optimized evaluates to %v, want %v", query, got.ItemsList(), want.ItemsList())
+		}
+	}
+}
@@ -17,19 +17,46 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/poolpOrg/go-setdb/query/ast"
 	"github.com/poolpOrg/go-setdb/query/lexer"
+	"github.com/poolpOrg/go-setdb/sets"
 )
 
+// binopPrecedence defines how tightly binary operators bind, higher binds
+// tighter and operators of equal precedence associate to the left:
+//
+//	&          intersection               20
+//	| - ^      union, difference, xor     10
+//
+// so that a | b & c parses as a | (b & c) and a - b | c as (a - b) | c.
+// Predicates are not binary operators, they bind looser than any of these
+// and can only appear once at the top of a statement.
 var binopPrecedence = map[lexer.TokenType]int{
 	lexer.UNION:                10,
-	lexer.INTERSECTION:         10,
+	lexer.INTERSECTION:         20,
 	lexer.DIFFERENCE:           10,
 	lexer.SYMMETRIC_DIFFERENCE: 10,
 }
 
+var predicates = map[lexer.TokenType]struct{}{
+	lexer.SUBSET:          {},
+	lexer.PROPER_SUBSET:   {},
+	lexer.SUPERSET:        {},
+	lexer.PROPER_SUPERSET: {},
+	lexer.EQUAL:           {},
+	lexer.NOT_EQUAL:       {},
+	lexer.DISJOINT:        {},
+}
+
+func isPredicate(tokenType lexer.TokenType) bool {
+	_, exists := predicates[tokenType]
+	return exists
+}
+
 func getTokenPrecedence(tokenType lexer.TokenType) int {
 	if value, exists := binopPrecedence[tokenType]; !exists {
 		return -1
@@ -38,11 +65,25 @@ func getTokenPrecedence(tokenType lexer.TokenType) int {
 	}
 }
 
+// isName returns true if a token is a set name. Keywords are names too
+// wherever a name is expected, so that sets named after a keyword can be
+// referenced without quotes.
+func isName(token lexer.Token) bool {
+	return token.Type() == lexer.SET || token.Type().IsKeyword()
+}
+
+var ErrSyntax = errors.New("syntax error")
+
+// ParserError describes where parsing failed, it wraps ErrSyntax.
 type ParserError struct {
 	token lexer.Token
 	msg   string
 }
 
+func (e ParserError) Unwrap() error {
+	return ErrSyntax
+}
+
 func (e ParserError) Error() string {
 	token := e.token
 	msg := e.msg
@@ -104,12 +145,19 @@ func (p *Parser) readToken() lexer.Token {
 	return token
 }
 
-func (p *Parser) Parse() (ast.Node, error) {
-	parsedAST, err := p.parseExpr()
+func (p *Parser) Parse() (ast.Statement, error) {
+	parsedAST, err := p.parseStatement()
 	if err != nil {
+		// a read error takes precedence as it likely caused the parse error
+		if lexErr := p.lexer.Err(); lexErr != nil {
+			return nil, lexErr
+		}
 		return nil, err
 	}
 	token := p.peekToken()
+	if lexErr := p.lexer.Err(); lexErr != nil {
+		return nil, lexErr
+	}
 	if token.Type() != lexer.EOF {
 		return nil, ParseError(token, "expected EOF")
 	}
@@ -123,16 +171,40 @@ func (p *Parser) parseInlineSet() (ast.Node, error) {
 		return nil, ParseError(token, "expected '{'")
 	}
 
-	items := make([]ast.Node, 0)
-	for {
-		token = p.peekToken()
-		if token.Type() == lexer.EOF || token.Type() == lexer.SET_CLOSE {
-			break
+	// a set name followed by IN starts a comprehension rather than a list
+	// of items, the name is read ahead to tell them apart
+	var first ast.Node
+	token = p.peekToken()
+	if isName(token) {
+		p.readToken()
+		if next := p.peekToken(); next.Type() == lexer.IN {
+			return p.parseComprehension(token)
+		}
+		set, err := p.parseNamedSet(token.Value())
+		if err != nil {
+			return nil, err
 		}
-		item, err := p.parseExpr()
+		first, err = p.parseExprBinOpRHS(0, set)
 		if err != nil {
 			return nil, err
 		}
+	}
+
+	items := make([]ast.Node, 0)
+	for {
+		item := first
+		first = nil
+		if item == nil {
+			token = p.peekToken()
+			if token.Type() == lexer.EOF || token.Type() == lexer.SET_CLOSE {
+				break
+			}
+			var err error
+			item, err = p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+		}
 		items = append(items, item)
 
 		token = p.peekToken()
@@ -152,52 +224,545 @@ func (p *Parser) parseInlineSet() (ast.Node, error) {
 	return &ast.Set{Node: items}, nil
 }
 
+// parseComprehension parses the remainder of a comprehension once its
+// variable has been read.
+func (p *Parser) parseComprehension(variable lexer.Token) (ast.Node, error) {
+	token := p.readToken()
+	if token.Type() != lexer.IN {
+		return nil, ParseError(token, "expected IN")
+	}
+
+	source, err := p.parseComprehensionSource()
+	if err != nil {
+		return nil, err
+	}
+	switch source.(type) {
+	case *ast.AssignExpr, *ast.MutateExpr:
+		return nil, ParseError(token, "assignment not allowed in comprehension")
+	}
+
+	token = p.readToken()
+	if token.Type() != lexer.UNION {
+		return nil, ParseError(token, "expected '|'")
+	}
+
+	predicate, err := p.parseItemPredicate(variable.Value())
+	if err != nil {
+		return nil, err
+	}
+
+	token = p.readToken()
+	if token.Type() != lexer.SET_CLOSE {
+		return nil, ParseError(token, "expected '}'")
+	}
+	return &ast.Comprehension{Var: variable.Value(), Source: source, Predicate: predicate}, nil
+}
+
+// parseComprehensionSource parses the source of a comprehension, which may
+// be any set expression. The first '|' at its top level separates it from
+// the predicate, so a union needs parentheses, other operators don't.
+func (p *Parser) parseComprehensionSource() (ast.Node, error) {
+	LHS, err := p.parseExprPrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		binOp := p.peekToken()
+		precedence := getTokenPrecedence(binOp.Type())
+		if precedence < 0 || binOp.Type() == lexer.UNION {
+			return LHS, nil
+		}
+		p.readToken()
+
+		// operators binding tighter are parsed as usual, they can't
+		// consume the '|' which has the lowest precedence
+		RHS, err := p.parseExprPrimary()
+		if err != nil {
+			return nil, err
+		}
+		RHS, err = p.parseExprBinOpRHS(precedence+1, RHS)
+		if err != nil {
+			return nil, err
+		}
+		LHS = &ast.BinaryExpr{Operator: binOp.Type(), LHS: LHS, RHS: RHS}
+	}
+}
+
+// parseItemPredicate parses the predicate of a comprehension, && binds
+// tighter than || and parentheses can be used to group predicates.
+func (p *Parser) parseItemPredicate(variable string) (ast.ItemPredicate, error) {
+	lhs, err := p.parseItemConjunction(variable)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		token := p.peekToken()
+		if token.Type() != lexer.OR {
+			return lhs, nil
+		}
+		p.readToken()
+		rhs, err := p.parseItemConjunction(variable)
+		if err != nil {
+			return nil, err
+		}
+		lhs = &ast.LogicalExpr{Operator: token.Type(), LHS: lhs, RHS: rhs}
+	}
+}
+
+func (p *Parser) parseItemConjunction(variable string) (ast.ItemPredicate, error) {
+	lhs, err := p.parseItemComparison(variable)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		token := p.peekToken()
+		if token.Type() != lexer.AND {
+			return lhs, nil
+		}
+		p.readToken()
+		rhs, err := p.parseItemComparison(variable)
+		if err != nil {
+			return nil, err
+		}
+		lhs = &ast.LogicalExpr{Operator: token.Type(), LHS: lhs, RHS: rhs}
+	}
+}
+
+func (p *Parser) parseItemComparison(variable string) (ast.ItemPredicate, error) {
+	token := p.readToken()
+	if token.Type() == lexer.GROUP_OPEN {
+		predicate, err := p.parseItemPredicate(variable)
+		if err != nil {
+			return nil, err
+		}
+		token = p.readToken()
+		if token.Type() != lexer.GROUP_CLOSE {
+			return nil, ParseError(token, "expected ')'")
+		}
+		return predicate, nil
+	}
+
+	if !isName(token) || token.Value() != variable {
+		return nil, ParseError(token, "expected %s", variable)
+	}
+
+	operator := p.readToken()
+	value, err := p.parseItem()
+	if err != nil {
+		return nil, err
+	}
+	predicate, err := ast.NewItemComparison(variable, operator.Type(), value.(*ast.Item))
+	if err != nil {
+		return nil, ParseError(operator, "%s", err)
+	}
+	return predicate, nil
+}
+
+func (p *Parser) parseGroup() (ast.Node, error) {
+	token := p.readToken()
+	if token.Type() != lexer.GROUP_OPEN {
+		return nil, ParseError(token, "expected '('")
+	}
+
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := expr.(*ast.AssignExpr); ok {
+		return nil, ParseError(token, "assignment not allowed in group")
+	}
+
+	token = p.readToken()
+	if token.Type() != lexer.GROUP_CLOSE {
+		return nil, ParseError(token, "expected ')'")
+	}
+	return expr, nil
+}
+
+func (p *Parser) parseDereference() (ast.Node, error) {
+	token := p.readToken()
+	if token.Type() != lexer.DEREFERENCE {
+		return nil, ParseError(token, "expected '*'")
+	}
+
+	expr, err := p.parseExprPrimary()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := expr.(*ast.AssignExpr); ok {
+		return nil, ParseError(token, "assignment not allowed in dereference")
+	}
+	return &ast.Dereference{Expr: expr}, nil
+}
+
 func (p *Parser) parseAssign() (ast.Node, error) {
 	token := p.readToken()
 	if token.Type() != lexer.ASSIGN {
 		return nil, ParseError(token, "expected set name")
 	}
-	return p.parseExpr()
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return p.parseTypeAssertion(expr)
+}
+
+// parseTypeAssertion parses the type an expression is declared with, if
+// any, as in x = y AS integer.
+func (p *Parser) parseTypeAssertion(expr ast.Node) (ast.Node, error) {
+	token := p.peekToken()
+	if token.Type() != lexer.AS {
+		return expr, nil
+	}
+	p.readToken()
+
+	token = p.readToken()
+	if token.Type() != lexer.SET {
+		return nil, ParseError(token, "expected type name")
+	}
+	itemType, err := sets.ParseType(token.Value())
+	if err != nil {
+		return nil, ParseError(token, "%s", err)
+	}
+	return &ast.TypeAssertion{Expr: expr, Type: itemType}, nil
 }
 
 func (p *Parser) parseSet() (ast.Node, error) {
 	token := p.readToken()
-	if token.Type() != lexer.SET {
+	if !isName(token) {
 		return nil, ParseError(token, "expected set name")
 	}
-	name := token.Value()
+	return p.parseNamedSet(token.Value())
+}
+
+// parseNamedSet parses what follows a set name once it has been read.
+func (p *Parser) parseNamedSet(name string) (ast.Node, error) {
+	token := p.peekToken()
+	if ast.IsWildcard(name) {
+		switch token.Type() {
+		case lexer.ASSIGN, lexer.ADD_ASSIGN, lexer.REMOVE_ASSIGN:
+			return nil, ParseError(token, "assignment not allowed to wildcard")
+		}
+		return &ast.Wildcard{Pattern: name, Operator: lexer.UNION}, nil
+	}
 
-	token = p.peekToken()
 	if token.Type() == lexer.ASSIGN {
 		expr, err := p.parseAssign()
 		if err != nil {
 			return nil, err
 		}
 		return &ast.AssignExpr{Name: name, Expr: expr}, nil
+	} else if token.Type() == lexer.ADD_ASSIGN || token.Type() == lexer.REMOVE_ASSIGN {
+		p.readToken()
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &ast.MutateExpr{Name: name, Operator: token.Type(), Expr: expr}, nil
 	}
 
 	return &ast.Set{Name: name}, nil
 }
 
+// parseWildcard parses a wildcard prefixed with the operator combining the
+// sets it matches, such as &team:* for their intersection.
+func (p *Parser) parseWildcard() (ast.Node, error) {
+	operator := p.readToken()
+	if operator.Type() != lexer.UNION && operator.Type() != lexer.INTERSECTION {
+		return nil, ParseError(operator, "expected '|' or '&'")
+	}
+
+	token := p.readToken()
+	if token.Type() != lexer.SET || !ast.IsWildcard(token.Value()) {
+		return nil, ParseError(token, "expected wildcard")
+	}
+	return &ast.Wildcard{Pattern: token.Value(), Operator: operator.Type()}, nil
+}
+
+// parseItem parses a literal item: a string, a boolean or a number, which
+// may be negative. Bare items starting with a digit which are not numbers
+// are strings, as all bare items were before items were typed: this keeps
+// identifiers such as 007 or numbers too large to be held as they are.
 func (p *Parser) parseItem() (ast.Node, error) {
 	token := p.readToken()
-	if token.Type() != lexer.ITEM {
-		return nil, ParseError(token, "expected item name")
+	switch token.Type() {
+	case lexer.STRING:
+		return &ast.Item{Value: sets.NewString(token.Value())}, nil
+
+	case lexer.BOOLEAN:
+		return &ast.Item{Value: sets.NewBoolean(token.Value() == "true")}, nil
+
+	case lexer.DIFFERENCE:
+		number := p.readToken()
+		if number.Type() != lexer.ITEM {
+			return nil, ParseError(number, "expected number")
+		}
+		if hasLeadingZero(number.Value()) {
+			return nil, ParseError(number, "invalid number: -%s", number.Value())
+		}
+		item, err := sets.ParseNumber("-" + number.Value())
+		if err != nil {
+			return nil, ParseError(number, "%s", err)
+		}
+		return &ast.Item{Value: item}, nil
+
+	case lexer.ITEM:
+		if !hasLeadingZero(token.Value()) {
+			if item, err := sets.ParseNumber(token.Value()); err == nil {
+				return &ast.Item{Value: item}, nil
+			}
+		}
+		return &ast.Item{Value: sets.NewString(token.Value())}, nil
+	}
+	return nil, ParseError(token, "expected item name")
+}
+
+// hasLeadingZero returns true if an item starts with a zero followed by a
+// digit, which is never how a number is written.
+func hasLeadingZero(item string) bool {
+	return len(item) > 1 && item[0] == '0' && item[1] >= '0' && item[1] <= '9'
+}
+
+// parseItemOrRange parses an item, or a range if the item is followed by
+// '..' and the upper bound.
+func (p *Parser) parseItemOrRange() (ast.Node, error) {
+	from, err := p.parseItem()
+	if err != nil {
+		return nil, err
+	}
+
+	token := p.peekToken()
+	if token.Type() != lexer.RANGE {
+		return from, nil
+	}
+	p.readToken()
+
+	to, err := p.parseItem()
+	if err != nil {
+		return nil, err
+	}
+	node, err := ast.NewRange(from.(*ast.Item), to.(*ast.Item))
+	if err != nil {
+		return nil, ParseError(token, "%s", err)
+	}
+	return node, nil
+}
+
+/* STATEMENT NODES */
+
+func (p *Parser) parseStatement() (ast.Statement, error) {
+	token := p.peekToken()
+	switch token.Type() {
+	case lexer.DROP, lexer.RENAME, lexer.MEMBERSHIP, lexer.EXPLAIN:
+		// a keyword starts a statement if what follows is what the
+		// statement expects, it is the name of a set otherwise
+		p.readToken()
+		if startsStatement(token.Type(), p.peekToken()) {
+			switch token.Type() {
+			case lexer.DROP:
+				return p.parseDrop()
+			case lexer.RENAME:
+				return p.parseRename()
+			case lexer.MEMBERSHIP:
+				return p.parseMembership()
+			default:
+				return p.parseExplain()
+			}
+		}
+		set, err := p.parseNamedSet(token.Value())
+		if err != nil {
+			return nil, err
+		}
+		expr, err := p.parseExprBinOpRHS(0, set)
+		if err != nil {
+			return nil, err
+		}
+		return p.parseExprStatement(expr)
+
+	case lexer.FUNCTION:
+		return p.parseCall()
+	}
+
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return p.parseExprStatement(expr)
+}
+
+// startsStatement returns true if a keyword followed by token starts a
+// statement. MEMBERSHIP followed by '-' looks up a negative number, a set
+// named membership has to be quoted to be followed by a difference.
+func startsStatement(keyword lexer.TokenType, token lexer.Token) bool {
+	switch keyword {
+	case lexer.DROP, lexer.RENAME:
+		return isName(token)
+	case lexer.MEMBERSHIP:
+		switch token.Type() {
+		case lexer.ITEM, lexer.STRING, lexer.BOOLEAN, lexer.DIFFERENCE:
+			return true
+		}
+	case lexer.EXPLAIN:
+		switch token.Type() {
+		case lexer.ITEM, lexer.STRING, lexer.BOOLEAN, lexer.SET_OPEN, lexer.GROUP_OPEN, lexer.DEREFERENCE, lexer.FUNCTION:
+			return true
+		}
+		return isName(token)
+	}
+	return false
+}
+
+// parseExprStatement parses what may follow the expression a statement
+// starts with: a type assertion or a predicate.
+func (p *Parser) parseExprStatement(expr ast.Node) (ast.Statement, error) {
+	switch expr.(type) {
+	case *ast.AssignExpr, *ast.MutateExpr:
+		return expr, nil
+	}
+
+	token := p.peekToken()
+	if token.Type() == lexer.AS {
+		return p.parseTypeAssertion(expr)
+	}
+	if !isPredicate(token.Type()) {
+		return expr, nil
+	}
+	return p.parsePredicate(expr)
+}
+
+// parseDrop parses a DROP statement once the keyword has been read, as do
+// the following functions for their own.
+func (p *Parser) parseDrop() (ast.Statement, error) {
+	token := p.readToken()
+	if !isName(token) {
+		return nil, ParseError(token, "expected set name")
+	}
+	name := token.Value()
+
+	return &ast.DropStmt{Name: name, Cascade: p.parseCascade()}, nil
+}
+
+func (p *Parser) parseRename() (ast.Statement, error) {
+	token := p.readToken()
+	if !isName(token) {
+		return nil, ParseError(token, "expected set name")
+	}
+	name := token.Value()
+
+	token = p.readToken()
+	if token.Type() != lexer.TO {
+		return nil, ParseError(token, "expected TO")
+	}
+
+	token = p.readToken()
+	if !isName(token) || ast.IsWildcard(token.Value()) {
+		return nil, ParseError(token, "expected set name")
+	}
+	newName := token.Value()
+
+	return &ast.RenameStmt{Name: name, NewName: newName, Cascade: p.parseCascade()}, nil
+}
+
+func (p *Parser) parseMembership() (ast.Statement, error) {
+	item, err := p.parseItem()
+	if err != nil {
+		return nil, err
+	}
+	return &ast.MembershipStmt{Item: item.(*ast.Item)}, nil
+}
+
+func (p *Parser) parseExplain() (ast.Statement, error) {
+	token := p.peekToken()
+	statement, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+	switch statement.(type) {
+	case *ast.DropStmt, *ast.RenameStmt, *ast.MembershipStmt, *ast.ExplainStmt:
+		return nil, ParseError(token, "expected expression")
+	}
+	return &ast.ExplainStmt{Statement: statement}, nil
+}
+
+func (p *Parser) parseCall() (ast.Statement, error) {
+	token := p.readToken()
+	if token.Type() != lexer.FUNCTION {
+		return nil, ParseError(token, "expected function name")
+	}
+	function := strings.ToLower(token.Value())
+	if !ast.IsAggregate(function) {
+		return nil, ParseError(token, "unknown function")
+	}
+
+	token = p.readToken()
+	if token.Type() != lexer.GROUP_OPEN {
+		return nil, ParseError(token, "expected '('")
+	}
+
+	arg, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	switch arg.(type) {
+	case *ast.AssignExpr, *ast.MutateExpr:
+		return nil, ParseError(token, "assignment not allowed in function call")
+	}
+
+	token = p.readToken()
+	if token.Type() != lexer.GROUP_CLOSE {
+		return nil, ParseError(token, "expected ')'")
+	}
+	return &ast.CallExpr{Function: function, Arg: arg}, nil
+}
+
+func (p *Parser) parseCascade() bool {
+	token := p.peekToken()
+	if token.Type() != lexer.CASCADE {
+		return false
+	}
+	p.readToken()
+	return true
+}
+
+func (p *Parser) parsePredicate(LHS ast.Node) (ast.Statement, error) {
+	token := p.readToken()
+	if !isPredicate(token.Type()) {
+		return nil, ParseError(token, "expected predicate")
+	}
+
+	RHS, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := RHS.(*ast.AssignExpr); ok {
+		return nil, ParseError(token, "assignment not allowed in predicate")
 	}
 
-	return &ast.Item{Name: token.Value()}, nil
+	return &ast.ComparisonExpr{
+		Operator: token.Type(),
+		LHS:      LHS,
+		RHS:      RHS,
+	}, nil
 }
 
 /* Expr NODES */
 
 func (p *Parser) parseExprPrimary() (ast.Node, error) {
 	token := p.peekToken()
-	if token.Type() == lexer.SET {
+	if isName(token) {
 		return p.parseSet()
-	} else if token.Type() == lexer.ITEM {
-		return p.parseItem()
+	} else if token.Type() == lexer.ITEM || token.Type() == lexer.STRING || token.Type() == lexer.BOOLEAN || token.Type() == lexer.DIFFERENCE {
+		return p.parseItemOrRange()
 	} else if token.Type() == lexer.SET_OPEN {
 		return p.parseInlineSet()
+	} else if token.Type() == lexer.GROUP_OPEN {
+		return p.parseGroup()
+	} else if token.Type() == lexer.DEREFERENCE {
+		return p.parseDereference()
+	} else if token.Type() == lexer.UNION || token.Type() == lexer.INTERSECTION {
+		return p.parseWildcard()
+	} else if token.Type() == lexer.FUNCTION {
+		return nil, ParseError(token, "function call not allowed in expression")
 	} else {
 		return nil, ParseError(token, "unexpected token %s", token.Type())
 	}
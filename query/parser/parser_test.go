@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package parser
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/poolpOrg/go-setdb/query/ast"
+	"github.com/poolpOrg/go-setdb/query/lexer"
+)
+
+func parse(query string) (ast.Statement, error) {
+	return NewParser(lexer.NewLexer(strings.NewReader(query))).Parse()
+}
+
+func TestParseComprehension(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"{i in u | i ~ '*:1'}", "{i in u | i ~ '*:1'}"},
+		{"{ i in u - {'x'} | i ~ '*:1' }", "{i in (u-{'x'}) | i ~ '*:1'}"},
+		{"{i in u ^ v | i ~ '*'}", "{i in (u^v) | i ~ '*'}"},
+		{"{i in u & v | i ~ '*'}", "{i in (u&v) | i ~ '*'}"},
+		{"{i in u - v & w | i ~ '*'}", "{i in (u-(v&w)) | i ~ '*'}"},
+		{"{i in u & v - w | i ~ '*'}", "{i in ((u&v)-w) | i ~ '*'}"},
+		{"{i in u - v ^ w | i ~ '*'}", "{i in ((u-v)^w) | i ~ '*'}"},
+		{"{i in (u | v) - w | i ~ '*'}", "{i in ((u|v)-w) | i ~ '*'}"},
+		{"{i in {j in u - v | j ~ 'a*'} | i ~ '*b'}", "{i in {j in (u-v) | j ~ 'a*'} | i ~ '*b'}"},
+	}
+
+	for _, test := range tests {
+		statement, err := parse(test.query)
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		if got := statement.ToQuery(); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.query, got, test.want)
+			continue
+		}
+		// the query as written must parse back to the same tree
+		reparsed, err := parse(statement.ToQuery())
+		if err != nil {
+			t.Errorf("%s: %v", statement.ToQuery(), err)
+		} else if reparsed.ToQuery() != statement.ToQuery() {
+			t.Errorf("%s: reparsed as %s", statement.ToQuery(), reparsed.ToQuery())
+		}
+	}
+}
+
+func TestParseKeywordNames(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"to = {1}", "`to` = {1}"},
+		{"drop | x", "`drop`|x"},
+		{"cascade - in", "`cascade`-`in`"},
+		{"x = as AS integer", "x = `as` AS integer"},
+		{"{in in in | in > 1}", "{`in` in `in` | `in` > 1}"},
+		{"count(as)", "count(`as`)"},
+		{"DROP to", "DROP `to`"},
+		{"drop drop cascade", "DROP `drop` CASCADE"},
+		{"RENAME rename TO to", "RENAME `rename` TO `to`"},
+		{"membership 1", "MEMBERSHIP 1"},
+		{"membership - 1", "MEMBERSHIP -1"},
+		{"membership | x", "`membership`|x"},
+		{"membership = {1}", "`membership` = {1}"},
+		{"explain = x", "`explain` = x"},
+		{"EXPLAIN explain", "EXPLAIN `explain`"},
+		{"EXPLAIN x | drop", "EXPLAIN x|`drop`"},
+	}
+
+	for _, test := range tests {
+		statement, err := parse(test.query)
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		if got := statement.ToQuery(); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.query, got, test.want)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []string{
+		"{i in u | v | i ~ '*'}",
+		"{i in u - | i ~ '*'}",
+		"{i in x = u | i ~ '*'}",
+		"{i in u}",
+		"EXPLAIN drop x",
+		"x as",
+	}
+
+	for _, query := range tests {
+		if statement, err := parse(query); !errors.Is(err, ErrSyntax) {
+			t.Errorf("%s: got %v, %v, want %v", query, statement, err, ErrSyntax)
+		}
+	}
+}
+
+func TestParseItem(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"{42}", "{42}"},
+		{"{0}", "{0}"},
+		{"{-0}", "{0}"},
+		{"{0.5}", "{0.5}"},
+		{"{0e3}", "{0.0}"},
+		{"{-42}", "{-42}"},
+		{"{9223372036854775807}", "{9223372036854775807}"},
+		{"{-9223372036854775808}", "{-9223372036854775808}"},
+		{"{true}", "{true}"},
+		{"{'42'}", "{'42'}"},
+
+		// not numbers, kept as strings as they were before items were typed
+		{"{007}", "{'007'}"},
+		{"{00.5}", "{'00.5'}"},
+		{"{9223372036854775808}", "{'9223372036854775808'}"},
+		{"{12345678901234567890123}", "{'12345678901234567890123'}"},
+		{"{1e400}", "{'1e400'}"},
+		{"{1e}", "{'1e'}"},
+		{"{42abc}", "{'42abc'}"},
+		{"{1:2}", "{'1:2'}"},
+	}
+
+	for _, test := range tests {
+		statement, err := parse(test.query)
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		if got := statement.ToQuery(); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.query, got, test.want)
+		}
+	}
+}
+
+func TestParseItemInvalid(t *testing.T) {
+	tests := []string{
+		"{-9223372036854775809}",
+		"{-007}",
+		"{-1e400}",
+		"{-abc}",
+	}
+
+	for _, query := range tests {
+		if statement, err := parse(query); !errors.Is(err, ErrSyntax) {
+			t.Errorf("%s: got %v, %v, want %v", query, statement, err, ErrSyntax)
+		}
+	}
+}
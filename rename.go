@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package setdb
+
+import (
+	"github.com/poolpOrg/go-setdb/query/ast"
+)
+
+// renameReferences rewrites every reference to a set in a pattern so that
+// it points to its new name.
+func renameReferences(node ast.Node, name string, newName string) ast.Node {
+	switch node := node.(type) {
+	case *ast.Set:
+		if node.Name == name {
+			node.Name = newName
+		}
+		for i, item := range node.Node {
+			node.Node[i] = renameReferences(item, name, newName)
+		}
+		return node
+
+	case *ast.BinaryExpr:
+		node.LHS = renameReferences(node.LHS, name, newName)
+		node.RHS = renameReferences(node.RHS, name, newName)
+		return node
+
+	case *ast.Dereference:
+		node.Expr = renameReferences(node.Expr, name, newName)
+		return node
+
+	case *ast.TypeAssertion:
+		node.Expr = renameReferences(node.Expr, name, newName)
+		return node
+
+	case *ast.Comprehension:
+		node.Source = renameReferences(node.Source, name, newName)
+		return node
+
+	default:
+		return node
+	}
+}
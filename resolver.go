@@ -0,0 +1,293 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package setdb
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/poolpOrg/go-setdb/query/ast"
+	"github.com/poolpOrg/go-setdb/query/optimizer"
+	"github.com/poolpOrg/go-setdb/sets"
+)
+
+// resolver resolves the sets referenced while evaluating the pattern of a
+// set, it records every set traversed and refuses to traverse the set
+// itself. Sets are evaluated as they are resolved so that their content can
+// be materialized.
+//
+// A resolver is meant to be used for a single evaluation: it memoizes the
+// sets it resolves, so a set referenced multiple times, directly or through
+// other sets, is only fetched and evaluated once.
+type resolver struct {
+	db        *Database
+	name      string
+	traversed []string
+	memo      map[string]*cacheEntry
+
+	// staged holds the sets changed by a transaction, which take precedence
+	// over the persisted ones
+	staged map[string]*cacheEntry
+
+	// stack holds the sets being evaluated, which wildcards don't match
+	stack []string
+}
+
+func (db *Database) newResolver(name string) *resolver {
+	return &resolver{
+		db:        db,
+		name:      name,
+		traversed: make([]string, 0),
+		memo:      make(map[string]*cacheEntry),
+		stack:     make([]string, 0),
+	}
+}
+
+func (r *resolver) resolve(name string) (*ast.ResolvedSet, error) {
+	if r.name == name {
+		return nil, fmt.Errorf("%w: %s", ErrCyclicReference, name)
+	}
+
+	if ast.IsWildcard(name) {
+		matched, err := r.expand(name, append([]string{r.name}, r.stack...))
+		if err != nil {
+			return nil, err
+		}
+		r.traversed = append(r.traversed, name)
+		names := make([]string, 0, len(matched))
+		for _, setInfo := range matched {
+			names = append(names, setInfo.Name)
+		}
+		return &ast.ResolvedSet{Name: name, Names: names}, nil
+	}
+
+	if entry, exists := r.staged[name]; exists {
+		if entry == nil {
+			return nil, fmt.Errorf("%w: %s", ErrSetNotFound, name)
+		}
+		if covers(entry.dependencies, r.name) {
+			return nil, fmt.Errorf("%w: %s", ErrCyclicReference, r.name)
+		}
+		r.traverse(entry)
+		return ast.NewMaterializedSet(name, nil, entry.items), nil
+	}
+
+	if entry, exists := r.memo[name]; exists {
+		r.traverse(entry)
+		return ast.NewMaterializedSet(name, nil, entry.items), nil
+	}
+
+	// cached sets depending on staged ones are outdated
+	if r.db.cache != nil {
+		if entry, exists := r.db.cache.get(name); exists && !r.dependsOnStaged(entry.dependencies) {
+			if covers(entry.dependencies, r.name) {
+				return nil, fmt.Errorf("%w: %s", ErrCyclicReference, r.name)
+			}
+			r.memo[name] = entry
+			r.traverse(entry)
+			return ast.NewMaterializedSet(name, nil, entry.items), nil
+		}
+	}
+
+	pattern, err := r.db.pattern(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// the sets traversed while evaluating the pattern are its dependencies
+	start := len(r.traversed)
+	r.stack = append(r.stack, name)
+	items, err := r.optimize(pattern).Evaluate(r.resolve)
+	r.stack = r.stack[:len(r.stack)-1]
+	if err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{
+		name:         name,
+		items:        items,
+		dependencies: uniqueNames(r.traversed[start:]),
+	}
+	r.traversed = append(r.traversed, name)
+
+	r.memo[name] = entry
+	if r.db.cache != nil && !r.dependsOnStaged(entry.dependencies) {
+		r.db.cache.put(name, entry.items, entry.dependencies)
+	}
+	return ast.NewMaterializedSet(name, pattern, items), nil
+}
+
+// sketch returns a sketch of the items of a set without evaluating it, from
+// the one persisted along with the set, unless it was persisted without one.
+func (r *resolver) sketch(name string) (*sets.HyperLogLog, error) {
+	if r.name == name {
+		return nil, fmt.Errorf("%w: %s", ErrCyclicReference, name)
+	}
+
+	serialized, err := r.db.backend.Sketch(name)
+	if err != nil {
+		return nil, err
+	}
+	if serialized == nil {
+		resolvedSet, err := r.resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		return resolvedSet.Items.Sketch(), nil
+	}
+
+	sketch := sets.NewHyperLogLog()
+	if err := sketch.UnmarshalBinary(serialized); err != nil {
+		return nil, err
+	}
+	r.traversed = append(r.traversed, name)
+	return sketch, nil
+}
+
+// optimize rewrites a node before it is evaluated, using the sets resolved
+// so far and the cached ones to estimate cardinalities.
+func (r *resolver) optimize(node ast.Node) ast.Node {
+	return optimizer.NewOptimizer(r.estimate).Optimize(node).(ast.Node)
+}
+
+func (r *resolver) estimate(name string) (int64, bool) {
+	if entry, exists := r.staged[name]; exists && entry != nil {
+		return entry.items.Length(), true
+	}
+	if entry, exists := r.memo[name]; exists {
+		return entry.items.Length(), true
+	}
+	if r.db.cache != nil {
+		if entry, exists := r.db.cache.peek(name); exists {
+			return entry.items.Length(), true
+		}
+	}
+	return 0, false
+}
+
+// require returns the dependencies of a set whose pattern references the
+// given sets: the sets themselves along with the sets they depend on, and
+// for wildcards the sets the matching sets depend on. They are computed from
+// the pattern rather than from the sets traversed, as the optimizer may
+// prune references from the evaluation.
+//
+// Sets matching a wildcard are not dependencies themselves, the wildcard
+// covers them and they can come and go.
+func (r *resolver) require(names []string) ([]string, error) {
+	dependencies := make([]string, 0)
+	for _, name := range names {
+		if r.name == name {
+			return nil, fmt.Errorf("%w: %s", ErrCyclicReference, name)
+		}
+
+		if ast.IsWildcard(name) {
+			matched, err := r.expand(name, []string{r.name})
+			if err != nil {
+				return nil, err
+			}
+			dependencies = append(dependencies, name)
+			for _, setInfo := range matched {
+				dependencies = append(dependencies, setInfo.DependsOn...)
+			}
+			continue
+		}
+
+		info, err := r.info(name)
+		if err != nil {
+			return nil, err
+		}
+		if covers(info.DependsOn, r.name) {
+			return nil, fmt.Errorf("%w: %s", ErrCyclicReference, r.name)
+		}
+		dependencies = append(dependencies, info.DependsOn...)
+		dependencies = append(dependencies, name)
+	}
+	return uniqueNames(dependencies), nil
+}
+
+// info returns the information of a set, staged sets depending on the sets
+// their new pattern references.
+func (r *resolver) info(name string) (SetInfo, error) {
+	entry, exists := r.staged[name]
+	if !exists {
+		return r.db.backend.Info(name)
+	}
+	if entry == nil {
+		return SetInfo{}, fmt.Errorf("%w: %s", ErrSetNotFound, name)
+	}
+	return SetInfo{Name: name, DependsOn: entry.dependencies}, nil
+}
+
+// expand returns the sets matching a wildcard as db.expand does, staged
+// sets being matched instead of the persisted ones.
+func (r *resolver) expand(wildcard string, excluded []string) ([]SetInfo, error) {
+	matched, err := r.db.expand(wildcard, excluded)
+	if err != nil || len(r.staged) == 0 {
+		return matched, err
+	}
+
+	ret := make([]SetInfo, 0, len(matched))
+	for _, setInfo := range matched {
+		if _, exists := r.staged[setInfo.Name]; !exists {
+			ret = append(ret, setInfo)
+		}
+	}
+	for name, entry := range r.staged {
+		setInfo := SetInfo{Name: name}
+		if entry != nil {
+			setInfo.DependsOn = entry.dependencies
+		}
+		if entry != nil && matchWildcard(wildcard, name) && !excludes(excluded, setInfo) {
+			ret = append(ret, setInfo)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
+
+// dependsOnStaged returns true if dependencies include a staged set.
+func (r *resolver) dependsOnStaged(dependencies []string) bool {
+	for name := range r.staged {
+		if covers(dependencies, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *resolver) traverse(entry *cacheEntry) {
+	r.traversed = append(r.traversed, entry.dependencies...)
+	r.traversed = append(r.traversed, entry.name)
+}
+
+// dependencies returns the sets traversed so far, each listed once.
+func (r *resolver) dependencies() []string {
+	return uniqueNames(r.traversed)
+}
+
+func uniqueNames(names []string) []string {
+	seen := make(map[string]struct{}, len(names))
+	ret := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, exists := seen[name]; !exists {
+			seen[name] = struct{}{}
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
@@ -29,32 +29,61 @@ import (
 	"github.com/google/uuid"
 	"github.com/poolpOrg/go-setdb/query/ast"
 	"github.com/poolpOrg/go-setdb/query/lexer"
+	"github.com/poolpOrg/go-setdb/query/optimizer"
 	"github.com/poolpOrg/go-setdb/query/parser"
 	"github.com/poolpOrg/go-setdb/sets"
 )
 
+// Backend is implemented by storage packages, which register themselves with
+// Register. Methods operating on a missing set wrap ErrSetNotFound, and
+// Rename wraps ErrSetExists if the new name is already in use.
+//
+// Persist maintains a sketch of the items of each set, see sets.HyperLogLog,
+// and a filter of them, see sets.BloomFilter, which Sketch and Filter return
+// serialized or nil for sets persisted without them.
 type Backend interface {
 	List() ([]SetInfo, error)
 	Info(string) (SetInfo, error)
 
-	Persist(name string, pattern string, dependencies []string) error
+	Persist(name string, pattern string, dependencies []string, items []string) error
 	Pattern(name string) (string, error)
+	MembershipOf(item string) ([]string, error)
+	Sketch(name string) ([]byte, error)
+	Filter(name string) ([]byte, error)
+
+	Delete(name string) error
+	Rename(name string, newName string) error
 
 	Close() error
 }
 
 var muBackends sync.Mutex
-var backends map[string]func(string) Backend = make(map[string]func(string) Backend)
+var backends map[string]func(string) (Backend, error) = make(map[string]func(string) (Backend, error))
 
 type Database struct {
 	backend Backend
 	name    string
+	cache   *cache
+	filters *filters
 }
 
+type ResultType int
+
+const (
+	SetResult ResultType = iota
+	BooleanResult
+	PlanResult
+	ScalarResult
+)
+
 type Set struct {
-	items *sets.Set
+	items   *sets.Set
+	boolean bool
+	scalar  float64
+	plan    *Plan
 
-	patternAST ast.Node
+	resultType ResultType
+	patternAST ast.Statement
 	name       string
 	database   *Database
 
@@ -69,52 +98,261 @@ func (db *Database) Query(pattern string) (*Set, error) {
 		return nil, err
 	}
 
+	switch node := queryAST.(type) {
+	case *ast.DropStmt:
+		if err := db.Drop(node.Name, node.Cascade); err != nil {
+			return nil, err
+		}
+		return &Set{items: sets.NewSet(), resultType: SetResult, database: db, patternAST: queryAST}, nil
+
+	case *ast.RenameStmt:
+		if err := db.Rename(node.Name, node.NewName, node.Cascade); err != nil {
+			return nil, err
+		}
+		return &Set{items: sets.NewSet(), resultType: SetResult, database: db, patternAST: queryAST}, nil
+
+	case *ast.MembershipStmt:
+		items, err := node.Item.Evaluate(nil)
+		if err != nil {
+			return nil, err
+		}
+		names, err := db.MembershipOf(items.ItemsList()[0])
+		if err != nil {
+			return nil, err
+		}
+		result := sets.NewSet()
+		for _, name := range names {
+			result.Add(sets.NewString(name))
+		}
+		return &Set{items: result, resultType: SetResult, database: db, patternAST: queryAST}, nil
+
+	case *ast.ExplainStmt:
+		plan, err := db.explain(node.Statement)
+		if err != nil {
+			return nil, err
+		}
+		return &Set{items: sets.NewSet(), plan: plan, resultType: PlanResult, database: db, patternAST: queryAST}, nil
+	}
+
 	name := ""
-	if node, ok := queryAST.(*ast.AssignExpr); ok {
+	switch node := queryAST.(type) {
+	case *ast.AssignExpr:
 		name = node.Name
 		queryAST = node.Expr
-	}
 
-	dependencies := make([]string, 0)
-	setResolver := func(_name string) (*ast.ResolvedSet, error) {
-		if name == _name {
-			return nil, fmt.Errorf("cyclic reference is forbidden")
+	case *ast.MutateExpr:
+		pattern, err := db.mutate(node)
+		if err != nil {
+			return nil, err
 		}
+		name = node.Name
+		queryAST = pattern
+	}
 
-		subpattern, err := db.backend.Pattern(_name)
+	setResolver := db.newResolver(name)
+
+	queryAST, err = db.dereference(queryAST)
+	if err != nil {
+		return nil, err
+	}
+
+	// references are checked even if the query isn't persisted, as the
+	// optimizer may prune them and a missing set must fail the query
+	dependencies, err := setResolver.require(ast.References(queryAST))
+	if err != nil {
+		return nil, err
+	}
+
+	// the optimized statement is evaluated, the original one is persisted
+	optimized := optimizer.NewOptimizer(setResolver.estimate).Optimize(queryAST)
+
+	if node, ok := optimized.(ast.BooleanNode); ok {
+		result, err := node.EvaluateBoolean(setResolver.resolve)
 		if err != nil {
 			return nil, err
 		}
-		subqueryParser := parser.NewParser(lexer.NewLexer(strings.NewReader(subpattern)))
-		subqueryAST, err := subqueryParser.Parse()
+		return &Set{
+			items:      sets.NewSet(),
+			boolean:    result,
+			resultType: BooleanResult,
+			database:   db,
+			patternAST: queryAST,
+			dependsOn:  setResolver.dependencies(),
+		}, nil
+	}
+
+	if node, ok := optimized.(ast.ScalarNode); ok {
+		var result float64
+		if call, ok := node.(*ast.CallExpr); ok && ast.IsApproximation(call.Function) {
+			result, err = call.EstimateScalar(setResolver.sketch, setResolver.resolve)
+		} else {
+			result, err = node.EvaluateScalar(setResolver.resolve)
+		}
 		if err != nil {
 			return nil, err
 		}
-		dependencies = append(dependencies, _name)
-		return ast.NewResolvedSet(name, subqueryAST), nil
+		return &Set{
+			items:      sets.NewSet(),
+			scalar:     result,
+			resultType: ScalarResult,
+			database:   db,
+			patternAST: queryAST,
+			dependsOn:  setResolver.dependencies(),
+		}, nil
 	}
 
-	resultset, err := queryAST.Evaluate(setResolver)
+	node, ok := optimized.(ast.Node)
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported statement: %s", ErrSyntax, queryAST.ToQuery())
+	}
+
+	resultset, err := node.Evaluate(setResolver.resolve)
 	if err != nil {
 		return nil, err
 	}
 
 	if name != "" {
-		err = db.backend.Persist(name, queryAST.ToQuery(), dependencies)
-		if err != nil {
+		// the sets depending on name are evaluated against its new content
+		// before anything is persisted, so a write breaking one of them
+		// fails without any effect
+		tx := db.begin()
+		tx.put(name, queryAST.ToQuery(), dependencies, resultset)
+		if err := tx.refresh(name); err != nil {
+			return nil, err
+		}
+		if err := tx.commit(); err != nil {
 			return nil, err
 		}
 	}
 
 	return &Set{
 		items:      resultset,
+		resultType: SetResult,
 		name:       name,
 		database:   db,
 		patternAST: queryAST,
-		dependsOn:  dependencies,
+		dependsOn:  setResolver.dependencies(),
 	}, err
 }
 
+func (db *Database) persist(name string, pattern ast.Node) error {
+	setResolver := db.newResolver(name)
+	dependencies, err := setResolver.require(ast.References(pattern))
+	if err != nil {
+		return err
+	}
+	resultset, err := setResolver.optimize(pattern).Evaluate(setResolver.resolve)
+	if err != nil {
+		return err
+	}
+	return db.store(name, pattern.ToQuery(), dependencies, resultset)
+}
+
+func (db *Database) store(name string, pattern string, dependencies []string, items *sets.Set) error {
+	if err := db.backend.Persist(name, pattern, dependencies, encodeItems(items)); err != nil {
+		return err
+	}
+	db.filters.invalidate(name)
+	if db.cache != nil {
+		db.cache.invalidate(name)
+		db.cache.put(name, items, dependencies)
+	}
+	return nil
+}
+
+// Reindex re-evaluates and re-persists every set, this rebuilds the items
+// held by the backend for databases created before they were tracked, and
+// migrates items persisted with their quotes to their canonical form.
+func (db *Database) Reindex() error {
+	setsInfo, err := db.backend.List()
+	if err != nil {
+		return err
+	}
+	sortByDependencies(setsInfo)
+
+	for _, setInfo := range setsInfo {
+		pattern, err := db.pattern(setInfo.Name)
+		if err != nil {
+			return err
+		}
+		if err := db.persist(setInfo.Name, pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateBooleans rewrites the patterns persisted before booleans were
+// introduced which reference sets named true or false, so that they
+// reference them quoted rather than hold booleans. It must be run once,
+// before any pattern holding a boolean is persisted: both are persisted the
+// same, so the sets referencing true or false would have their booleans
+// turned into references as well.
+func (db *Database) MigrateBooleans() error {
+	setsInfo, err := db.backend.List()
+	if err != nil {
+		return err
+	}
+	sortByDependencies(setsInfo)
+
+	for _, setInfo := range setsInfo {
+		if !containsName(setInfo.DependsOn, "true") && !containsName(setInfo.DependsOn, "false") {
+			continue
+		}
+		pattern, err := db.backend.Pattern(setInfo.Name)
+		if err != nil {
+			return err
+		}
+		queryParser := parser.NewParser(lexer.NewLegacyLexer(strings.NewReader(pattern)))
+		queryAST, err := queryParser.Parse()
+		if err != nil {
+			return fmt.Errorf("%w: %s: %s", ErrInvalidPattern, setInfo.Name, err)
+		}
+		node, ok := queryAST.(ast.Node)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrInvalidPattern, setInfo.Name)
+		}
+		if err := db.persist(setInfo.Name, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MembershipOf returns the names of the persisted sets containing item.
+func (db *Database) MembershipOf(item sets.Item) ([]string, error) {
+	return db.backend.MembershipOf(item.String())
+}
+
+// encodeItems returns items as they are handed to backends: written as in a
+// query, so that items of different types are never equal.
+func encodeItems(items *sets.Set) []string {
+	ret := make([]string, 0, items.Length())
+	for _, item := range items.ItemsList() {
+		ret = append(ret, item.String())
+	}
+	return ret
+}
+
+func (db *Database) pattern(name string) (ast.Node, error) {
+	pattern, err := db.backend.Pattern(name)
+	if err != nil {
+		return nil, err
+	}
+	// a stored pattern that doesn't parse is not the client's fault, it is
+	// reported as invalid rather than as a syntax error
+	queryParser := parser.NewParser(lexer.NewLexer(strings.NewReader(pattern)))
+	queryAST, err := queryParser.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrInvalidPattern, name, err)
+	}
+	node, ok := queryAST.(ast.Node)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPattern, name)
+	}
+	return node, nil
+}
+
 type SetInfo struct {
 	Name      string    `json:"name"`
 	Uuid      uuid.UUID `json:"uuid"`
@@ -123,7 +361,7 @@ type SetInfo struct {
 	DependsOn []string  `json:"dependsOn"`
 }
 
-func Register(backendName string, backend func(string) Backend) {
+func Register(backendName string, backend func(string) (Backend, error)) {
 	muBackends.Lock()
 	defer muBackends.Unlock()
 	if _, ok := backends[backendName]; ok {
@@ -151,11 +389,16 @@ func Open(backendName string, dbname string) (*Database, error) {
 	defer muBackends.Unlock()
 
 	if backend, exists := backends[backendName]; !exists {
-		return nil, fmt.Errorf("backend %s does not exist", backendName)
+		return nil, fmt.Errorf("%w: %s", ErrBackendNotFound, backendName)
 	} else {
+		conn, err := backend(dbname)
+		if err != nil {
+			return nil, err
+		}
 		database := &Database{}
 		database.name = dbname
-		database.backend = backend(dbname)
+		database.backend = conn
+		database.filters = newFilters()
 		return database, nil
 	}
 }
@@ -176,10 +419,159 @@ func (db *Database) Info(name string) (SetInfo, error) {
 	return db.backend.Info(name)
 }
 
+// dependents returns the sets that reference name, directly or through
+// other sets, as recorded at the time they were persisted.
+func (db *Database) dependents(name string) ([]SetInfo, error) {
+	setsInfo, err := db.backend.List()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]SetInfo, 0)
+	for _, setInfo := range setsInfo {
+		if containsName(setInfo.DependsOn, name) {
+			ret = append(ret, setInfo)
+		}
+	}
+	sortByDependencies(ret)
+	return ret, nil
+}
+
+// affected returns the sets whose content depends on name, either because
+// they reference it or because they reference a wildcard matching it.
+func (db *Database) affected(name string) ([]SetInfo, error) {
+	setsInfo, err := db.backend.List()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]SetInfo, 0)
+	for _, setInfo := range setsInfo {
+		if setInfo.Name != name && covers(setInfo.DependsOn, name) {
+			ret = append(ret, setInfo)
+		}
+	}
+	sortByDependencies(ret)
+	return ret, nil
+}
+
+// sortByDependencies orders sets so that every set comes after the sets it
+// depends on: dependencies are transitive, so a set always has more of them
+// than any of the sets it depends on.
+func sortByDependencies(setsInfo []SetInfo) {
+	sort.SliceStable(setsInfo, func(i, j int) bool {
+		return len(setsInfo[i].DependsOn) < len(setsInfo[j].DependsOn)
+	})
+}
+
+func dependentsNames(setsInfo []SetInfo) string {
+	names := make([]string, 0, len(setsInfo))
+	for _, setInfo := range setsInfo {
+		names = append(names, setInfo.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Drop deletes a set, it fails if other sets reference it unless cascade is
+// set, in which case the sets referencing it are deleted as well.
+func (db *Database) Drop(name string, cascade bool) error {
+	dependents, err := db.dependents(name)
+	if err != nil {
+		return err
+	}
+	if len(dependents) != 0 && !cascade {
+		return fmt.Errorf("%w: %s (by %s)", ErrSetReferenced, name, dependentsNames(dependents))
+	}
+
+	// dependencies are transitive, so every set that would dangle once name
+	// is deleted is already part of dependents
+	tx := db.begin()
+	for _, dependent := range dependents {
+		tx.delete(dependent.Name)
+	}
+	if _, err := db.backend.Info(name); err != nil {
+		return err
+	}
+	tx.delete(name)
+
+	// sets referencing a wildcard matching name no longer hold its items
+	if err := tx.refresh(name); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// Rename renames a set, it fails if other sets reference it unless cascade
+// is set, in which case the patterns of the sets referencing it are rewritten
+// to use the new name.
+func (db *Database) Rename(name string, newName string, cascade bool) error {
+	dependents, err := db.dependents(name)
+	if err != nil {
+		return err
+	}
+	if len(dependents) != 0 && !cascade {
+		return fmt.Errorf("%w: %s (by %s)", ErrSetReferenced, name, dependentsNames(dependents))
+	}
+
+	if _, err := db.backend.Info(newName); err == nil {
+		return fmt.Errorf("%w: %s", ErrSetExists, newName)
+	}
+	tx := db.begin()
+	if err := tx.rename(name, newName); err != nil {
+		return err
+	}
+
+	// dependents are ordered so that a set is rewritten after the sets it
+	// references, which is required to evaluate it
+	for _, dependent := range dependents {
+		pattern, err := db.pattern(dependent.Name)
+		if err != nil {
+			return err
+		}
+		pattern = renameReferences(pattern, name, newName)
+		if err := tx.evaluate(dependent.Name, pattern); err != nil {
+			return err
+		}
+	}
+
+	// the set may have moved in or out of the wildcards referenced by others
+	if err := tx.refresh(name); err != nil {
+		return err
+	}
+	if err := tx.refresh(newName); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
 func (s *Set) Pattern() string {
 	return s.patternAST.ToQuery()
 }
 
-func (s *Set) Items() []string {
+// Items returns the items of the set in a stable order, see sets.Compare.
+func (s *Set) Items() []sets.Item {
 	return s.items.ItemsList()
 }
+
+// Iterator walks the items of the set in the same order as Items without
+// materializing them.
+func (s *Set) Iterator() *sets.Iterator {
+	return s.items.Iterator()
+}
+
+func (s *Set) Type() ResultType {
+	return s.resultType
+}
+
+func (s *Set) Boolean() bool {
+	return s.boolean
+}
+
+func (s *Set) Scalar() float64 {
+	return s.scalar
+}
+
+func (s *Set) Plan() *Plan {
+	return s.plan
+}
@@ -0,0 +1,871 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package setdb_test
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poolpOrg/go-setdb"
+	"github.com/poolpOrg/go-setdb/sets"
+	_ "github.com/poolpOrg/go-setdb/storage/memory"
+	_ "github.com/poolpOrg/go-setdb/storage/sqlite"
+)
+
+// openDatabase returns an in-memory database holding the sets assigned by
+// the given queries.
+func openDatabase(t *testing.T, queries ...string) *setdb.Database {
+	t.Helper()
+	db, err := setdb.Open("memory", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, query := range queries {
+		if _, err := db.Query(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	return db
+}
+
+// items returns the items of a query as written in a query.
+func items(t *testing.T, db *setdb.Database, query string) string {
+	t.Helper()
+	set, err := db.Query(query)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	ret := make([]string, 0)
+	for _, item := range set.Items() {
+		ret = append(ret, item.String())
+	}
+	return strings.Join(ret, " ")
+}
+
+func TestQueryMissingSet(t *testing.T) {
+	db := openDatabase(t, "a = {1, 2}")
+
+	tests := []string{
+		"nope",
+		"nope - nope",
+		"nope ^ nope",
+		"nope & {}",
+		"{} & nope",
+		"nope - {}",
+		"{} - nope",
+		"nope | nope",
+		"a & nope & {}",
+		"{ i in nope & {} | i == 1 }",
+		"count(nope & {})",
+		"nope - nope == {}",
+		"x = nope - nope",
+	}
+
+	for _, query := range tests {
+		if _, err := db.Query(query); !errors.Is(err, setdb.ErrSetNotFound) {
+			t.Errorf("%s: got %v, want %v", query, err, setdb.ErrSetNotFound)
+		}
+		if _, err := db.Explain(query); !errors.Is(err, setdb.ErrSetNotFound) {
+			t.Errorf("EXPLAIN %s: got %v, want %v", query, err, setdb.ErrSetNotFound)
+		}
+	}
+
+	// pruning still applies to sets that exist
+	if got := items(t, db, "a - a"); got != "" {
+		t.Errorf("a - a = [%s], want []", got)
+	}
+}
+
+// TestRangeMembership checks that a range holds the same items whether it
+// is enumerated or kept as a filter by the optimizer.
+func TestRangeMembership(t *testing.T) {
+	db := openDatabase(t, "words = {'a', 'apple', 'c', 'e', 'ee', 'f'}")
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"{'a'..'e'}", "'a' 'b' 'c' 'd' 'e'"},
+		{"{'a'..'e'} & {'apple'}", ""},
+		{"{'a'..'e'} & words", "'a' 'c' 'e'"},
+		{"words & {'a'..'e'}", "'a' 'c' 'e'"},
+		{"words - {'a'..'e'}", "'apple' 'ee' 'f'"},
+		// too large to be folded, kept as a filter
+		{"words & {' '..'\\uffff'}", "'a' 'c' 'e' 'f'"},
+		{"words - {' '..'\\uffff'}", "'apple' 'ee'"},
+		{"{1..5} & {0, 3, 5, 6}", "3 5"},
+		{"{0, 3, 5, 6} - {1..1000000}", "0"},
+	}
+	for _, test := range tests {
+		if got := items(t, db, test.query); got != test.want {
+			t.Errorf("%s = [%s], want [%s]", test.query, got, test.want)
+		}
+	}
+
+	predicates := []struct {
+		query string
+		want  bool
+	}{
+		{"{'apple'} <= {'a'..'e'}", false},
+		{"{'c'} <= {'a'..'e'}", true},
+		{"{'a'..'e'} & {'apple'} == {}", true},
+	}
+	for _, test := range predicates {
+		set, err := db.Query(test.query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		if set.Boolean() != test.want {
+			t.Errorf("%s = %v, want %v", test.query, set.Boolean(), test.want)
+		}
+	}
+
+	for _, query := range []string{"{'aa'..'ab'}", "{'aa'..'ab'} & {'aaz'}", "{'a'..'apple'}"} {
+		if _, err := db.Query(query); !errors.Is(err, setdb.ErrSyntax) {
+			t.Errorf("%s: got %v, want %v", query, err, setdb.ErrSyntax)
+		}
+	}
+}
+
+func TestComprehensionSource(t *testing.T) {
+	db := openDatabase(t, "u = {'a:1', 'b:1', 'x', 'c:2'}")
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"{ i in u - {'x'} | i ~ '*:1' }", "'a:1' 'b:1'"},
+		{"{i in u ^ {'a:1', 'd:1'} | i ~ '*:1'}", "'b:1' 'd:1'"},
+		{"{i in u - {'b:1'} & u | i ~ '*:1'}", "'a:1'"},
+		{"{i in (u | {'e:1'}) - {'a:1'} | i ~ '*:1'}", "'b:1' 'e:1'"},
+	}
+	for _, test := range tests {
+		if got := items(t, db, test.query); got != test.want {
+			t.Errorf("%s = [%s], want [%s]", test.query, got, test.want)
+		}
+	}
+}
+
+func TestQuotedSetNames(t *testing.T) {
+	db := openDatabase(t,
+		"`to` = {1, 2}",
+		"`my set` = {3}",
+		"x = `to` | `my set`",
+		"y = {`in` in x | `in` > 1}",
+	)
+
+	if got := items(t, db, "`to`"); got != "1 2" {
+		t.Errorf("`to` = [%s], want [1 2]", got)
+	}
+
+	// x and y are refreshed from their persisted pattern
+	if _, err := db.Query("`to` += {4}"); err != nil {
+		t.Fatal(err)
+	}
+	if got := items(t, db, "x"); got != "1 2 3 4" {
+		t.Errorf("x = [%s], want [1 2 3 4]", got)
+	}
+	if got := items(t, db, "y"); got != "2 3 4" {
+		t.Errorf("y = [%s], want [2 3 4]", got)
+	}
+
+	if _, err := db.Query("RENAME `to` TO `as` CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+	if got := items(t, db, "x"); got != "1 2 3 4" {
+		t.Errorf("x = [%s], want [1 2 3 4]", got)
+	}
+	// every persisted pattern parses back
+	if err := db.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	// keywords are set names wherever a set name is expected
+	if got := items(t, db, "{in in as | in > 2}"); got != "4" {
+		t.Errorf("{in in as | in > 2} = [%s], want [4]", got)
+	}
+}
+
+// TestDropRename runs with the cache enabled as well, entries of dropped or
+// renamed sets and of the sets referencing them must not be served.
+func TestDropRename(t *testing.T) {
+	t.Run("uncached", func(t *testing.T) { testDropRename(t, 0) })
+	t.Run("cached", func(t *testing.T) { testDropRename(t, 16) })
+}
+
+func testDropRename(t *testing.T, capacity int) {
+	setup := []string{
+		"a = {1, 2}",
+		"b = a | {3}",
+		"c = b - {1}",
+		"d = {4}",
+		"w = x:*",
+		"x:1 = {6}",
+	}
+	open := func(t *testing.T) *setdb.Database {
+		db := openDatabase(t)
+		db.EnableCache(capacity)
+		for _, query := range setup {
+			if _, err := db.Query(query); err != nil {
+				t.Fatalf("%s: %v", query, err)
+			}
+		}
+		// every set is evaluated, and cached
+		for _, name := range []string{"a", "b", "c", "d", "w"} {
+			items(t, db, name)
+		}
+		return db
+	}
+
+	t.Run("drop", func(t *testing.T) {
+		db := open(t)
+		if _, err := db.Query("DROP a"); !errors.Is(err, setdb.ErrSetReferenced) {
+			t.Fatalf("DROP a: got %v, want %v", err, setdb.ErrSetReferenced)
+		}
+		if got := items(t, db, "c"); got != "2 3" {
+			t.Errorf("c = [%s], want [2 3]", got)
+		}
+
+		if _, err := db.Query("DROP d"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Query("DROP a CASCADE"); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"a", "b", "c", "d"} {
+			if _, err := db.Info(name); !errors.Is(err, setdb.ErrSetNotFound) {
+				t.Errorf("%s: got %v, want %v", name, err, setdb.ErrSetNotFound)
+			}
+		}
+		for _, name := range []string{"a", "c"} {
+			if _, err := db.Query(name); !errors.Is(err, setdb.ErrSetNotFound) {
+				t.Errorf("%s: got %v, want %v", name, err, setdb.ErrSetNotFound)
+			}
+		}
+		if _, err := db.Query("DROP a"); !errors.Is(err, setdb.ErrSetNotFound) {
+			t.Errorf("DROP a: got %v, want %v", err, setdb.ErrSetNotFound)
+		}
+
+		if _, err := db.Query("DROP x:1"); err != nil {
+			t.Fatal(err)
+		}
+		if got := items(t, db, "w"); got != "" {
+			t.Errorf("w = [%s], want []", got)
+		}
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		db := open(t)
+		if _, err := db.Query("RENAME a TO x"); !errors.Is(err, setdb.ErrSetReferenced) {
+			t.Fatalf("RENAME a TO x: got %v, want %v", err, setdb.ErrSetReferenced)
+		}
+		if _, err := db.Query("RENAME d TO b"); !errors.Is(err, setdb.ErrSetExists) {
+			t.Errorf("RENAME d TO b: got %v, want %v", err, setdb.ErrSetExists)
+		}
+
+		if _, err := db.Query("RENAME d TO e"); err != nil {
+			t.Fatal(err)
+		}
+		if got := items(t, db, "e"); got != "4" {
+			t.Errorf("e = [%s], want [4]", got)
+		}
+
+		if _, err := db.Query("RENAME a TO to CASCADE"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Info("a"); !errors.Is(err, setdb.ErrSetNotFound) {
+			t.Errorf("a: got %v, want %v", err, setdb.ErrSetNotFound)
+		}
+		info, err := db.Info("b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(info.DependsOn) != "[to]" {
+			t.Errorf("b depends on %v, want [to]", info.DependsOn)
+		}
+
+		// references are rewritten: writes to the renamed set reach its
+		// dependents, and every persisted pattern parses back
+		if _, err := db.Query("to += {5}"); err != nil {
+			t.Fatal(err)
+		}
+		if got := items(t, db, "c"); got != "2 3 5" {
+			t.Errorf("c = [%s], want [2 3 5]", got)
+		}
+		if _, err := db.Query("a"); !errors.Is(err, setdb.ErrSetNotFound) {
+			t.Errorf("a: got %v, want %v", err, setdb.ErrSetNotFound)
+		}
+		if err := db.Reindex(); err != nil {
+			t.Fatal(err)
+		}
+
+		// a set renamed in or out of a wildcard
+		if _, err := db.Query("RENAME e TO x:2"); err != nil {
+			t.Fatal(err)
+		}
+		if got := items(t, db, "w"); got != "4 6" {
+			t.Errorf("w = [%s], want [4 6]", got)
+		}
+		if _, err := db.Query("RENAME x:1 TO y"); err != nil {
+			t.Fatal(err)
+		}
+		if got := items(t, db, "w"); got != "4" {
+			t.Errorf("w = [%s], want [4]", got)
+		}
+
+		if stats := db.CacheStats(); capacity != 0 && stats.Hits == 0 {
+			t.Errorf("cache stats %+v, want hits", stats)
+		}
+	})
+}
+
+func TestBareItems(t *testing.T) {
+	db := openDatabase(t,
+		"ids = {007, 12345678901234567890123, 42}",
+		"True = {1}",
+		"x = True | {true}",
+	)
+
+	if err := db.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	if got := items(t, db, "ids"); got != "42 '007' '12345678901234567890123'" {
+		t.Errorf("ids = [%s], want [42 '007' '12345678901234567890123']", got)
+	}
+	if got := items(t, db, "ids & {'007'}"); got != "'007'" {
+		t.Errorf("ids & {'007'} = [%s], want ['007']", got)
+	}
+	if got := items(t, db, "x"); got != "true 1" {
+		t.Errorf("x = [%s], want [true 1]", got)
+	}
+}
+
+// describe returns a plan as its node, query and cardinality followed by
+// the description of its children.
+func describe(plan *setdb.Plan) string {
+	ret := fmt.Sprintf("%s %s=%d", plan.Node, plan.Query, plan.Cardinality)
+	if len(plan.Children) != 0 {
+		children := make([]string, 0, len(plan.Children))
+		for _, child := range plan.Children {
+			children = append(children, describe(child))
+		}
+		ret += " [" + strings.Join(children, ", ") + "]"
+	}
+	return ret
+}
+
+func TestExplain(t *testing.T) {
+	db := openDatabase(t,
+		"a = {1, 2, 3}",
+		"b = {2, 3, 4}",
+		"c = a & b",
+		"x:1 = {7}",
+		"w = x:*",
+	)
+	c := "set c=2 [intersection a&b=2 [set a=3 [inline set {1,2,3}=3], set b=3 [inline set {2,3,4}=3]]]"
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"c | {5}", "query c|{5}=3 [union {5}|c=3 [inline set {5}=1, " + c + "]]"},
+		{"EXPLAIN c | {5}", "query c|{5}=3 [union {5}|c=3 [inline set {5}=1, " + c + "]]"},
+		{"d = c - {2}", "query d = c-{2}=1 [difference c-{2}=1 [" + c + ", inline set {2}=1]]"},
+		{"{2} <= c", "query {2}<=c=0 [predicate {2}<=c=0 [inline set {2}=1, " + c + "]]"},
+		{"count(c)", "query count(c)=0 [function count(c)=0 [" + c + "]]"},
+		{"y = w | {1}", "query y = w|{1}=2 [union {1}|w=2 [inline set {1}=1, set w=1 [wildcard x:*=1 [set x:1=1 [inline set {7}=1]]]]]"},
+	}
+	for _, test := range tests {
+		plan, err := db.Explain(test.query)
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		if got := describe(plan); got != test.want {
+			t.Errorf("%s:\n got %s\nwant %s", test.query, got, test.want)
+		}
+		if !plan.Evaluated || len(plan.Children) != 1 {
+			t.Errorf("%s: evaluated %v with %d children", test.query, plan.Evaluated, len(plan.Children))
+		}
+	}
+
+	// assignments are explained without being persisted
+	if _, err := db.Info("d"); !errors.Is(err, setdb.ErrSetNotFound) {
+		t.Errorf("d: got %v, want %v", err, setdb.ErrSetNotFound)
+	}
+	if got := describe(mustExplain(t, db, "c")); !strings.Contains(got, "set a=3") {
+		t.Errorf("c: plan %s", got)
+	}
+
+	// queries failing on a cycle fail the same when explained
+	for _, query := range []string{"x = x | {1}", "a = c", "a = {1} | c", "x:2 = w | {1}"} {
+		if _, err := db.Query(query); !errors.Is(err, setdb.ErrCyclicReference) {
+			t.Errorf("%s: got %v, want %v", query, err, setdb.ErrCyclicReference)
+		}
+		if _, err := db.Explain(query); !errors.Is(err, setdb.ErrCyclicReference) {
+			t.Errorf("EXPLAIN %s: got %v, want %v", query, err, setdb.ErrCyclicReference)
+		}
+	}
+}
+
+func mustExplain(t *testing.T, db *setdb.Database, query string) *setdb.Plan {
+	t.Helper()
+	plan, err := db.Explain(query)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return plan
+}
+
+// pattern returns the pattern persisted for a set, as explained.
+func pattern(t *testing.T, db *setdb.Database, name string) string {
+	t.Helper()
+	return mustExplain(t, db, name).Children[0].Pattern
+}
+
+// TestMutate runs mutations in sequence, checking the pattern they leave
+// for the set mutated and the items of c, which references it through b.
+func TestMutate(t *testing.T) {
+	db := openDatabase(t,
+		"a = {1, 2}",
+		"b = a | {5}",
+		"c = b - {1}",
+		"t = {1} AS integer",
+	)
+
+	tests := []struct {
+		query   string
+		pattern string
+		items   string
+		c       string
+	}{
+		{"a += {3}", "{1,2,3}", "1 2 3", "2 3 5"},
+		{"a -= {1}", "{2,3}", "2 3", "2 3 5"},
+		{"a += {2, 3}", "{2,3}", "2 3", "2 3 5"},
+		{"a += {}", "{2,3}", "2 3", "2 3 5"},
+		// removing absent items from literal items leaves them as is
+		{"a -= {9, 'x'}", "{2,3}", "2 3", "2 3 5"},
+		{"a -= {}", "{2,3}", "2 3", "2 3 5"},
+
+		// the literal part of a referencing pattern is edited
+		{"b += {6}", "a|{5,6}", "2 3 5 6", "2 3 5 6"},
+		{"b -= {2}", "(a|{5,6})-{2}", "3 5 6", "3 5 6"},
+		{"b += {2}", "a|{5,6,2}", "2 3 5 6", "2 3 5 6"},
+		{"b -= {9}", "(a|{5,6,2})-{9}", "2 3 5 6", "2 3 5 6"},
+		{"b -= {9}", "(a|{5,6,2})-{9}", "2 3 5 6", "2 3 5 6"},
+		{"c += {1}", "b|{1}", "1 2 3 5 6", "1 2 3 5 6"},
+		{"c -= {3}", "(b|{1})-{3}", "1 2 5 6", "1 2 5 6"},
+
+		// items are evaluated when mutating, not referenced
+		{"a += b", "{2,3,5,6}", "2 3 5 6", "1 2 5 6"},
+		{"a -= {i in b | i > 5}", "{2,3,5}", "2 3 5", "1 2 5 6"},
+
+		{"t += {2}", "{1,2} AS integer", "1 2", "1 2 5 6"},
+		{"t -= {1}", "{2} AS integer", "2", "1 2 5 6"},
+	}
+	for _, test := range tests {
+		if _, err := db.Query(test.query); err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		name := strings.Fields(test.query)[0]
+		if got := pattern(t, db, name); got != test.pattern {
+			t.Errorf("%s: pattern %s, want %s", test.query, got, test.pattern)
+		}
+		if got := items(t, db, name); got != test.items {
+			t.Errorf("%s: %s = [%s], want [%s]", test.query, name, got, test.items)
+		}
+		if got := items(t, db, "c"); got != test.c {
+			t.Errorf("%s: c = [%s], want [%s]", test.query, got, test.c)
+		}
+	}
+
+	invalid := []struct {
+		query string
+		err   error
+	}{
+		{"nope += {1}", setdb.ErrSetNotFound},
+		{"nope -= {1}", setdb.ErrSetNotFound},
+		{"a += nope", setdb.ErrSetNotFound},
+		{"t += {'x'}", setdb.ErrTypeMismatch},
+	}
+	for _, test := range invalid {
+		if _, err := db.Query(test.query); !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.query, err, test.err)
+		}
+	}
+	if _, err := db.Info("nope"); !errors.Is(err, setdb.ErrSetNotFound) {
+		t.Errorf("nope: got %v, want %v", err, setdb.ErrSetNotFound)
+	}
+	if got := pattern(t, db, "t"); got != "{2} AS integer" {
+		t.Errorf("t: pattern %s, want {2} AS integer", got)
+	}
+}
+
+func TestContains(t *testing.T) {
+	db := openDatabase(t,
+		"a = {1..2000}",
+		"b = a - {1..1000} | {'x'}",
+		"w = x:*",
+	)
+
+	// answers are exact, false positives of the filter are evaluated
+	for i := int64(0); i <= 3000; i++ {
+		want := i >= 1001 && i <= 2000
+		if got, err := db.Contains("b", sets.NewInteger(i)); err != nil || got != want {
+			t.Fatalf("Contains(b, %d) = %v, %v, want %v", i, got, err, want)
+		}
+	}
+	for _, item := range []sets.Item{sets.NewString("x"), sets.NewString("1500"), sets.NewBoolean(true)} {
+		want := item.String() == "'x'"
+		if got, err := db.Contains("b", item); err != nil || got != want {
+			t.Errorf("Contains(b, %s) = %v, %v, want %v", item, got, err, want)
+		}
+	}
+
+	for _, name := range []string{"nope", "x:*", "*"} {
+		if _, err := db.Contains(name, sets.NewInteger(1)); !errors.Is(err, setdb.ErrSetNotFound) {
+			t.Errorf("Contains(%s, 1): got %v, want %v", name, err, setdb.ErrSetNotFound)
+		}
+	}
+
+	// filters loaded above follow writes to the sets depended on, directly
+	// or through a wildcard
+	writes := []struct {
+		query string
+		name  string
+		item  sets.Item
+		want  bool
+	}{
+		{"a += {5000}", "b", sets.NewInteger(5000), true},
+		{"a -= {1500}", "b", sets.NewInteger(1500), false},
+		{"a = {'y'}", "b", sets.NewString("y"), true},
+		{"a = {'y'}", "b", sets.NewInteger(1001), false},
+		{"x:1 = {7}", "w", sets.NewInteger(7), true},
+		{"DROP x:1", "w", sets.NewInteger(7), false},
+	}
+	for _, test := range writes {
+		if _, err := db.Contains(test.name, test.item); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Query(test.query); err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		if got, err := db.Contains(test.name, test.item); err != nil || got != test.want {
+			t.Errorf("%s: Contains(%s, %s) = %v, %v, want %v", test.query, test.name, test.item, got, err, test.want)
+		}
+	}
+}
+
+// TestContainsWithoutFilter removes the filters persisted along sets, as
+// for sets persisted before they were.
+func TestContainsWithoutFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters.db")
+	db, err := setdb.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, query := range []string{"a = {1, 2}", "b = a | {3}"} {
+		if _, err := db.Query(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Exec("DELETE FROM filters"); err != nil {
+		t.Fatal(err)
+	}
+	filters := func() int {
+		var count int
+		if err := conn.QueryRow("SELECT COUNT(*) FROM filters").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	// a new handle, so that no filter is held in memory
+	db, err = setdb.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := int64(0); i <= 4; i++ {
+		want := i >= 1 && i <= 3
+		if got, err := db.Contains("b", sets.NewInteger(i)); err != nil || got != want {
+			t.Errorf("Contains(b, %d) = %v, %v, want %v", i, got, err, want)
+		}
+	}
+
+	if _, err := db.Query("a += {4}"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Contains("b", sets.NewInteger(4)); err != nil || !got {
+		t.Errorf("Contains(b, 4) = %v, %v, want true", got, err)
+	}
+	if err := db.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	if count := filters(); count != 2 {
+		t.Errorf("%d filters once reindexed, want 2", count)
+	}
+}
+
+// TestMigrateBooleans persists patterns as they were before booleans were
+// introduced, referencing sets named true and false unquoted.
+func TestMigrateBooleans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	db, err := setdb.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, query := range []string{
+		"`true` = {1}",
+		"`false` = {3}",
+		"x = `true` | {2}",
+		"y = {i in x | i > 1} | `false`",
+		"z = {true}",
+	} {
+		if _, err := db.Query(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	legacy := map[string]string{
+		"x": "true|{2}",
+		"y": "{i in x | i > 1}|false",
+	}
+	for name, pattern := range legacy {
+		if _, err := conn.Exec("UPDATE sets SET pattern=? WHERE name=?", pattern, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.MigrateBooleans(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"x": "`true`|{2}",
+		"y": "{i in x | i > 1}|`false`",
+		"z": "{true}",
+	}
+	for name, pattern := range want {
+		var got string
+		if err := conn.QueryRow("SELECT pattern FROM sets WHERE name=?", name).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != pattern {
+			t.Errorf("%s: pattern %s, want %s", name, got, pattern)
+		}
+	}
+
+	// migrated patterns follow writes to the sets they reference
+	if _, err := db.Query("`true` += {5}"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"x", "1 2 5"},
+		{"y", "2 3 5"},
+		{"z", "true"},
+	}
+	for _, test := range tests {
+		if got := items(t, db, test.query); got != test.want {
+			t.Errorf("%s = [%s], want [%s]", test.query, got, test.want)
+		}
+	}
+}
+
+// TestLargeLiteralSet checks that literal items are gathered into a single
+// set, unioning them one at a time takes minutes for sets this large.
+func TestLargeLiteralSet(t *testing.T) {
+	db := openDatabase(t)
+
+	for _, kind := range []string{"integers", "strings", "mixed"} {
+		literals := make([]string, 0, 20000)
+		for i := 0; i < 20000; i++ {
+			switch {
+			case kind == "integers", kind == "mixed" && i%2 == 0:
+				literals = append(literals, strconv.Itoa(i%15000))
+			default:
+				literals = append(literals, fmt.Sprintf("'item:%d'", i%15000))
+			}
+		}
+		query := "{" + strings.Join(literals, ", ") + "}"
+
+		start := time.Now()
+		set, err := db.Query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("%s: evaluated in %s", kind, elapsed)
+		}
+		if got := len(set.Items()); got != 15000 {
+			t.Errorf("%s: got %d items, want 15000", kind, got)
+		}
+	}
+}
+
+// membership returns the names of the sets holding an item, space-joined.
+func membership(t *testing.T, db *setdb.Database, item string) string {
+	t.Helper()
+	set, err := db.Query("MEMBERSHIP " + item)
+	if err != nil {
+		t.Fatalf("MEMBERSHIP %s: %v", item, err)
+	}
+	names := make([]string, 0)
+	for _, item := range set.Items() {
+		names = append(names, item.String())
+	}
+	return strings.Join(names, " ")
+}
+
+func TestWriteDependents(t *testing.T) {
+	db := openDatabase(t,
+		"a = {1, 2}",
+		"b = a | {3}",
+		"c = b & {2, 3, 5}",
+		"x:1 = {7}",
+		"all = x:*",
+	)
+
+	// dependents are re-persisted with the new content of a
+	if _, err := db.Query("a = {5}"); err != nil {
+		t.Fatal(err)
+	}
+	memberships := []struct {
+		item string
+		want string
+	}{
+		{"1", ""},
+		{"2", ""},
+		{"3", "'b' 'c'"},
+		{"5", "'a' 'b' 'c'"},
+	}
+	for _, test := range memberships {
+		if got := membership(t, db, test.item); got != test.want {
+			t.Errorf("MEMBERSHIP %s = [%s], want [%s]", test.item, got, test.want)
+		}
+	}
+
+	// the persisted sketch and filter of b follow a
+	set, err := db.Query("approx_count(b)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Scalar() < 1.5 || set.Scalar() > 2.5 {
+		t.Errorf("approx_count(b) = %f, want 2", set.Scalar())
+	}
+	for item, want := range map[sets.Item]bool{sets.NewInteger(5): true, sets.NewInteger(1): false} {
+		if got, err := db.Contains("b", item); err != nil || got != want {
+			t.Errorf("Contains(b, %s) = %v, %v, want %v", item, got, err, want)
+		}
+	}
+
+	// sets created under a wildcard are part of the sets referencing it
+	if _, err := db.Query("x:2 = {8}"); err != nil {
+		t.Fatal(err)
+	}
+	if got := membership(t, db, "8"); got != "'all' 'x:2'" {
+		t.Errorf("MEMBERSHIP 8 = [%s], want ['all' 'x:2']", got)
+	}
+	if got, err := db.Contains("all", sets.NewInteger(8)); err != nil || !got {
+		t.Errorf("Contains(all, 8) = %v, %v, want true", got, err)
+	}
+}
+
+// TestWriteBreakingDependent checks that a write failing to re-evaluate a
+// set depending on it has no effect.
+func TestWriteBreakingDependent(t *testing.T) {
+	t.Run("uncached", func(t *testing.T) { testWriteBreakingDependent(t, 0) })
+	t.Run("cached", func(t *testing.T) { testWriteBreakingDependent(t, 16) })
+}
+
+func testWriteBreakingDependent(t *testing.T, capacity int) {
+	db := openDatabase(t)
+	db.EnableCache(capacity)
+	for _, query := range []string{
+		"a = {1}",
+		"t = a AS integer",
+		"u = t | {2}",
+		"x:1 = {1}",
+		"xs = x:* AS integer",
+	} {
+		if _, err := db.Query(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+
+	writes := []string{
+		"a = {'x'}",
+		"a += {'x'}",
+		"x:2 = {'x'}",
+		"x:1 = {'x'}",
+	}
+	for _, query := range writes {
+		if _, err := db.Query(query); !errors.Is(err, setdb.ErrTypeMismatch) {
+			t.Errorf("%s: got %v, want %v", query, err, setdb.ErrTypeMismatch)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"a", "1"},
+		{"t", "1"},
+		{"u", "1 2"},
+		{"xs", "1"},
+		{"x:*", "1"},
+	}
+	for _, test := range tests {
+		if got := items(t, db, test.query); got != test.want {
+			t.Errorf("%s = [%s], want [%s]", test.query, got, test.want)
+		}
+	}
+	if got := membership(t, db, "1"); got != "'a' 't' 'u' 'x:1' 'xs'" {
+		t.Errorf("MEMBERSHIP 1 = [%s], want ['a' 't' 'u' 'x:1' 'xs']", got)
+	}
+	if got := membership(t, db, "'x'"); got != "" {
+		t.Errorf("MEMBERSHIP 'x' = [%s], want []", got)
+	}
+	if _, err := db.Info("x:2"); !errors.Is(err, setdb.ErrSetNotFound) {
+		t.Errorf("x:2: got %v, want %v", err, setdb.ErrSetNotFound)
+	}
+	if got, err := db.Contains("t", sets.NewInteger(1)); err != nil || !got {
+		t.Errorf("Contains(t, 1) = %v, %v, want true", got, err)
+	}
+}
@@ -0,0 +1,567 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sets
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// bitmap is a compressed bitmap of integers in the spirit of Roaring: the
+// integers are split on their high 48 bits into containers holding their
+// low 16 bits, either as a sorted array while sparse or as a bitmap of 65536
+// bits once dense. Containers are ordered, so integers are too.
+type bitmap struct {
+	keys       []uint64
+	containers []*container
+}
+
+// integers are shifted so that their order is preserved once unsigned
+func splitInteger(value int64) (uint64, uint16) {
+	u := uint64(value) ^ (1 << 63)
+	return u >> 16, uint16(u)
+}
+
+func joinInteger(key uint64, low uint16) int64 {
+	return int64((key<<16 | uint64(low)) ^ (1 << 63))
+}
+
+func newBitmap() *bitmap {
+	return &bitmap{}
+}
+
+func (b *bitmap) find(key uint64) (int, bool) {
+	i := sort.Search(len(b.keys), func(i int) bool { return b.keys[i] >= key })
+	return i, i < len(b.keys) && b.keys[i] == key
+}
+
+func (b *bitmap) contains(value int64) bool {
+	key, low := splitInteger(value)
+	i, found := b.find(key)
+	return found && b.containers[i].contains(low)
+}
+
+func (b *bitmap) add(value int64) bool {
+	key, low := splitInteger(value)
+	i, found := b.find(key)
+	if !found {
+		b.keys = append(b.keys, 0)
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = key
+		b.containers = append(b.containers, nil)
+		copy(b.containers[i+1:], b.containers[i:])
+		b.containers[i] = &container{}
+	}
+	return b.containers[i].add(low)
+}
+
+func (b *bitmap) remove(value int64) bool {
+	key, low := splitInteger(value)
+	i, found := b.find(key)
+	if !found || !b.containers[i].remove(low) {
+		return false
+	}
+	if b.containers[i].cardinality == 0 {
+		b.keys = append(b.keys[:i], b.keys[i+1:]...)
+		b.containers = append(b.containers[:i], b.containers[i+1:]...)
+	}
+	return true
+}
+
+func (b *bitmap) cardinality() int64 {
+	var ret int64
+	for _, c := range b.containers {
+		ret += int64(c.cardinality)
+	}
+	return ret
+}
+
+// each calls fn for every integer in ascending order, until it returns false.
+func (b *bitmap) each(fn func(int64) bool) {
+	for i, c := range b.containers {
+		key := b.keys[i]
+		if !c.each(func(low uint16) bool { return fn(joinInteger(key, low)) }) {
+			return
+		}
+	}
+}
+
+// cursor walks the integers of a bitmap in ascending order, the bitmap
+// must not be modified meanwhile.
+type cursor struct {
+	b   *bitmap
+	i   int
+	low int
+}
+
+func (b *bitmap) cursor() *cursor {
+	return &cursor{b: b}
+}
+
+func (c *cursor) next() (int64, bool) {
+	for c.i < len(c.b.containers) {
+		if low, ok := c.b.containers[c.i].next(c.low); ok {
+			c.low = int(low) + 1
+			return joinInteger(c.b.keys[c.i], low), true
+		}
+		c.i++
+		c.low = 0
+	}
+	return 0, false
+}
+
+// seek moves the cursor so that next returns the first integer greater
+// than or equal to value.
+func (c *cursor) seek(value int64) {
+	key, low := splitInteger(value)
+	i, found := c.b.find(key)
+	c.i, c.low = i, 0
+	if found {
+		c.low = int(low)
+	}
+}
+
+// end moves the cursor past the last integer.
+func (c *cursor) end() {
+	c.i, c.low = len(c.b.containers), 0
+}
+
+// skip moves the cursor past n integers, whole containers are skipped
+// based on their cardinality, and returns how many were actually skipped.
+func (c *cursor) skip(n int64) int64 {
+	var skipped int64
+	for skipped < n && c.i < len(c.b.containers) {
+		remaining := int64(c.b.containers[c.i].rank(c.low))
+		if skipped+remaining <= n {
+			skipped += remaining
+			c.i++
+			c.low = 0
+			continue
+		}
+		for skipped < n {
+			c.next()
+			skipped++
+		}
+	}
+	return skipped
+}
+
+func (b *bitmap) clone() *bitmap {
+	ret := &bitmap{
+		keys:       append([]uint64(nil), b.keys...),
+		containers: make([]*container, 0, len(b.containers)),
+	}
+	for _, c := range b.containers {
+		ret.containers = append(ret.containers, c.clone())
+	}
+	return ret
+}
+
+// combine gathers the containers of every key across bitmaps at once, so
+// that the cost of an operation is linear in the number of containers
+// rather than in the number of bitmaps times their size. op computes the
+// container of a key from those of the bitmaps holding it, first telling
+// whether the first bitmap is one of them, in which case its container
+// comes first. Empty containers are dropped.
+func combine(bitmaps []*bitmap, op func(containers []*container, first bool) *container) *bitmap {
+	type entry struct {
+		key     uint64
+		operand int
+		c       *container
+	}
+	entries := make([]entry, 0)
+	for i, b := range bitmaps {
+		for j, key := range b.keys {
+			entries = append(entries, entry{key, i, b.containers[j]})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].key != entries[j].key {
+			return entries[i].key < entries[j].key
+		}
+		return entries[i].operand < entries[j].operand
+	})
+
+	ret := newBitmap()
+	containers := make([]*container, 0, len(bitmaps))
+	for i := 0; i < len(entries); {
+		key, first := entries[i].key, entries[i].operand == 0
+		containers = containers[:0]
+		for ; i < len(entries) && entries[i].key == key; i++ {
+			containers = append(containers, entries[i].c)
+		}
+		if c := op(containers, first); c != nil && c.cardinality != 0 {
+			ret.keys = append(ret.keys, key)
+			ret.containers = append(ret.containers, c)
+		}
+	}
+	return ret
+}
+
+func unionBitmaps(bitmaps ...*bitmap) *bitmap {
+	return combine(bitmaps, func(containers []*container, _ bool) *container {
+		return countContainers(containers, false)
+	})
+}
+
+func intersectionBitmaps(bitmaps ...*bitmap) *bitmap {
+	return combine(bitmaps, func(containers []*container, _ bool) *container {
+		if len(containers) != len(bitmaps) {
+			return nil
+		}
+		// the smallest containers first keep the intermediate ones small
+		sort.Slice(containers, func(i, j int) bool {
+			return containers[i].cardinality < containers[j].cardinality
+		})
+		ret := containers[0].clone()
+		for _, c := range containers[1:] {
+			if ret.cardinality == 0 {
+				break
+			}
+			ret = combineContainers(ret, c, func(x, y uint64) uint64 { return x & y })
+		}
+		return ret
+	})
+}
+
+func differenceBitmaps(bitmaps ...*bitmap) *bitmap {
+	return combine(bitmaps, func(containers []*container, first bool) *container {
+		if !first {
+			return nil
+		}
+		if len(containers) == 1 {
+			return containers[0].clone()
+		}
+		others := countContainers(containers[1:], false)
+		return combineContainers(containers[0], others, func(x, y uint64) uint64 { return x &^ y })
+	})
+}
+
+func symmetricDifferenceBitmaps(bitmaps ...*bitmap) *bitmap {
+	return combine(bitmaps, func(containers []*container, _ bool) *container {
+		return countContainers(containers, true)
+	})
+}
+
+func (b *bitmap) intersection(other *bitmap) *bitmap {
+	return intersectionBitmaps(b, other)
+}
+
+func (b *bitmap) difference(other *bitmap) *bitmap {
+	return differenceBitmaps(b, other)
+}
+
+// arrayMaxCardinality is the cardinality past which a container is held as
+// a bitmap, 4096 uint16 take as much room as 65536 bits.
+const arrayMaxCardinality = 4096
+
+const bitmapWords = 1 << 16 / 64
+
+type container struct {
+	array       []uint16
+	words       []uint64
+	cardinality int
+}
+
+func (c *container) isBitmap() bool {
+	return c.words != nil
+}
+
+func (c *container) search(low uint16) (int, bool) {
+	i := sort.Search(len(c.array), func(i int) bool { return c.array[i] >= low })
+	return i, i < len(c.array) && c.array[i] == low
+}
+
+func (c *container) contains(low uint16) bool {
+	if c.isBitmap() {
+		return c.words[low/64]&(1<<(low%64)) != 0
+	}
+	_, found := c.search(low)
+	return found
+}
+
+func (c *container) add(low uint16) bool {
+	if c.isBitmap() {
+		if c.words[low/64]&(1<<(low%64)) != 0 {
+			return false
+		}
+		c.words[low/64] |= 1 << (low % 64)
+		c.cardinality++
+		return true
+	}
+
+	i, found := c.search(low)
+	if found {
+		return false
+	}
+	c.array = append(c.array, 0)
+	copy(c.array[i+1:], c.array[i:])
+	c.array[i] = low
+	c.cardinality++
+	if c.cardinality > arrayMaxCardinality {
+		c.words = c.toWords()
+		c.array = nil
+	}
+	return true
+}
+
+func (c *container) remove(low uint16) bool {
+	if c.isBitmap() {
+		if c.words[low/64]&(1<<(low%64)) == 0 {
+			return false
+		}
+		c.words[low/64] &^= 1 << (low % 64)
+		c.cardinality--
+		if c.cardinality <= arrayMaxCardinality {
+			c.array = c.toArray()
+			c.words = nil
+		}
+		return true
+	}
+
+	i, found := c.search(low)
+	if !found {
+		return false
+	}
+	c.array = append(c.array[:i], c.array[i+1:]...)
+	c.cardinality--
+	return true
+}
+
+func (c *container) each(fn func(uint16) bool) bool {
+	if !c.isBitmap() {
+		for _, low := range c.array {
+			if !fn(low) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for i, word := range c.words {
+		for word != 0 {
+			bit := bits.TrailingZeros64(word)
+			if !fn(uint16(i*64 + bit)) {
+				return false
+			}
+			word &= word - 1
+		}
+	}
+	return true
+}
+
+// next returns the first value greater than or equal to from.
+func (c *container) next(from int) (uint16, bool) {
+	if from > 0xffff {
+		return 0, false
+	}
+	if !c.isBitmap() {
+		i, _ := c.search(uint16(from))
+		if i == len(c.array) {
+			return 0, false
+		}
+		return c.array[i], true
+	}
+
+	i := from / 64
+	word := c.words[i] &^ (1<<(from%64) - 1)
+	for {
+		if word != 0 {
+			return uint16(i*64 + bits.TrailingZeros64(word)), true
+		}
+		i++
+		if i == len(c.words) {
+			return 0, false
+		}
+		word = c.words[i]
+	}
+}
+
+// rank returns the number of values greater than or equal to from.
+func (c *container) rank(from int) int {
+	if from > 0xffff {
+		return 0
+	}
+	if !c.isBitmap() {
+		i, _ := c.search(uint16(from))
+		return len(c.array) - i
+	}
+
+	i := from / 64
+	ret := bits.OnesCount64(c.words[i] &^ (1<<(from%64) - 1))
+	for _, word := range c.words[i+1:] {
+		ret += bits.OnesCount64(word)
+	}
+	return ret
+}
+
+func (c *container) toWords() []uint64 {
+	if c.isBitmap() {
+		return c.words
+	}
+	words := make([]uint64, bitmapWords)
+	for _, low := range c.array {
+		words[low/64] |= 1 << (low % 64)
+	}
+	return words
+}
+
+func (c *container) toArray() []uint16 {
+	array := make([]uint16, 0, c.cardinality)
+	c.each(func(low uint16) bool {
+		array = append(array, low)
+		return true
+	})
+	return array
+}
+
+func (c *container) clone() *container {
+	return &container{
+		array:       append([]uint16(nil), c.array...),
+		words:       append([]uint64(nil), c.words...),
+		cardinality: c.cardinality,
+	}
+}
+
+// countContainers returns the values found in any of the containers, or
+// in exactly one of them if once is set. Values are sorted and counted when
+// they fit an array, otherwise they are accumulated word by word into a
+// single bitmap.
+func countContainers(containers []*container, once bool) *container {
+	if len(containers) == 1 {
+		return containers[0].clone()
+	}
+
+	total := 0
+	for _, c := range containers {
+		total += c.cardinality
+	}
+	if total <= arrayMaxCardinality {
+		values := make([]uint16, 0, total)
+		for _, c := range containers {
+			values = append(values, c.toArray()...)
+		}
+		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+		array := make([]uint16, 0, len(values))
+		for i := 0; i < len(values); {
+			j := i + 1
+			for j < len(values) && values[j] == values[i] {
+				j++
+			}
+			if !once || j-i == 1 {
+				array = append(array, values[i])
+			}
+			i = j
+		}
+		return (&container{array: array}).normalized()
+	}
+
+	seen, more := make([]uint64, bitmapWords), make([]uint64, bitmapWords)
+	for _, c := range containers {
+		if c.isBitmap() {
+			for i, word := range c.words {
+				more[i] |= seen[i] & word
+				seen[i] |= word
+			}
+			continue
+		}
+		for _, low := range c.array {
+			bit := uint64(1) << (low % 64)
+			more[low/64] |= seen[low/64] & bit
+			seen[low/64] |= bit
+		}
+	}
+
+	cardinality := 0
+	for i := range seen {
+		if once {
+			seen[i] &^= more[i]
+		}
+		cardinality += bits.OnesCount64(seen[i])
+	}
+	return (&container{words: seen, cardinality: cardinality}).normalized()
+}
+
+// combineContainers applies a bitwise operation to two containers, arrays
+// are merged directly while containers involving a bitmap are combined
+// word by word.
+func combineContainers(a *container, b *container, op func(uint64, uint64) uint64) *container {
+	if !a.isBitmap() && !b.isBitmap() {
+		return (&container{array: mergeArrays(a.array, b.array, op)}).normalized()
+	}
+
+	x, y := a.toWords(), b.toWords()
+	words := make([]uint64, bitmapWords)
+	cardinality := 0
+	for i := range words {
+		words[i] = op(x[i], y[i])
+		cardinality += bits.OnesCount64(words[i])
+	}
+	return (&container{words: words, cardinality: cardinality}).normalized()
+}
+
+// mergeArrays merges two sorted arrays, op tells from the presence of a
+// value in each of them whether it is part of the result.
+func mergeArrays(a []uint16, b []uint16, op func(uint64, uint64) uint64) []uint16 {
+	ret := make([]uint16, 0)
+	keep := func(value uint16, inA uint64, inB uint64) {
+		if op(inA, inB) != 0 {
+			ret = append(ret, value)
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			keep(a[i], 1, 0)
+			i++
+		case a[i] > b[j]:
+			keep(b[j], 0, 1)
+			j++
+		default:
+			keep(a[i], 1, 1)
+			i++
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		keep(a[i], 1, 0)
+	}
+	for ; j < len(b); j++ {
+		keep(b[j], 0, 1)
+	}
+	return ret
+}
+
+// normalized picks the representation matching the cardinality.
+func (c *container) normalized() *container {
+	if !c.isBitmap() {
+		c.cardinality = len(c.array)
+		if c.cardinality > arrayMaxCardinality {
+			c.words = c.toWords()
+			c.array = nil
+		}
+		return c
+	}
+	if c.cardinality <= arrayMaxCardinality {
+		c.array = c.toArray()
+		c.words = nil
+	}
+	return c
+}
@@ -0,0 +1,430 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sets
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// integerSets returns sets of integers exercising every kind of container:
+// sparse ones held as arrays, dense ones held as bitmaps, and integers
+// spread across several containers including the extreme ones.
+func integerSets() map[string][]int64 {
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int, lo int64, hi int64) []int64 {
+		ret := make([]int64, 0, n)
+		for i := 0; i < n; i++ {
+			ret = append(ret, lo+rng.Int63n(hi-lo))
+		}
+		return ret
+	}
+	span := func(lo int64, hi int64) []int64 {
+		ret := make([]int64, 0, hi-lo)
+		for i := lo; i < hi; i++ {
+			ret = append(ret, i)
+		}
+		return ret
+	}
+
+	return map[string][]int64{
+		"empty":    {},
+		"single":   {42},
+		"extremes": {math.MinInt64, -1, 0, 1, math.MaxInt64},
+		"sparse":   random(100, -1<<20, 1<<20),
+		"dense":    random(8000, 0, 1<<16),
+		"span":     span(-2000, 8000),
+		"edge":     span(arrayMaxCardinality-10, arrayMaxCardinality+10),
+		"run":      span(1<<16, 1<<16+12000),
+		"full":     span(2<<16, 3<<16),
+		"mixed":    append(random(5000, 0, 1<<16), random(50, 1<<40, 1<<41)...),
+	}
+}
+
+// asSlice returns a set holding integers in a sorted slice rather than in
+// a bitmap, along with a string so that it is never converted back.
+func asSlice(integers []int64) *Set {
+	set := &Set{}
+	for _, value := range integers {
+		set.add(NewInteger(value))
+	}
+	set.add(NewString("sentinel"))
+	set.Remove(NewString("sentinel"))
+	return set
+}
+
+func asBitmap(integers []int64) *Set {
+	set := NewSet()
+	for _, value := range integers {
+		set.Add(NewInteger(value))
+	}
+	return set
+}
+
+// operand holds integers as a reference for set operations, which are
+// computed with plain maps.
+type operand struct {
+	values  []int64
+	members map[int64]struct{}
+}
+
+func newOperand(integers []int64) operand {
+	members := make(map[int64]struct{}, len(integers))
+	for _, value := range integers {
+		members[value] = struct{}{}
+	}
+	values := make([]int64, 0, len(members))
+	for value := range members {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return operand{values: values, members: members}
+}
+
+var (
+	inAny = func(in []bool) bool {
+		for _, found := range in {
+			if found {
+				return true
+			}
+		}
+		return false
+	}
+	inAll = func(in []bool) bool {
+		for _, found := range in {
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+	inFirstOnly = func(in []bool) bool {
+		return in[0] && !inAny(in[1:])
+	}
+	inOne = func(in []bool) bool {
+		count := 0
+		for _, found := range in {
+			if found {
+				count++
+			}
+		}
+		return count == 1
+	}
+)
+
+// reference returns the integers of operands whose presence in each of
+// them is accepted by keep.
+func reference(keep func([]bool) bool, operands ...operand) []Item {
+	candidates := make([]int64, 0)
+	for _, operand := range operands {
+		candidates = append(candidates, operand.values...)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+
+	ret := make([]Item, 0)
+	in := make([]bool, len(operands))
+	for i, value := range candidates {
+		if i > 0 && candidates[i-1] == value {
+			continue
+		}
+		for j, operand := range operands {
+			_, in[j] = operand.members[value]
+		}
+		if keep(in) {
+			ret = append(ret, NewInteger(value))
+		}
+	}
+	return ret
+}
+
+func TestBitmapOperations(t *testing.T) {
+	integerSets := integerSets()
+	names := make([]string, 0, len(integerSets))
+	for name := range integerSets {
+		// full containers are covered with multiple operands, comparing
+		// every pair of sets with them is slow
+		if name != "full" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	operations := []struct {
+		name string
+		op   func(...*Set) *Set
+		keep func([]bool) bool
+	}{
+		{"union", Union, inAny},
+		{"intersection", Intersection, inAll},
+		{"difference", Difference, inFirstOnly},
+		{"symmetric difference", SymmetricDifference, inOne},
+	}
+
+	operands := make(map[string]operand, len(names))
+	bitmaps := make(map[string]*Set, len(names))
+	slices := make(map[string]*Set, len(names))
+	for _, name := range names {
+		operands[name] = newOperand(integerSets[name])
+		bitmaps[name] = asBitmap(integerSets[name])
+		slices[name] = asSlice(integerSets[name])
+	}
+
+	for _, a := range names {
+		for _, b := range names {
+			for _, operation := range operations {
+				want := reference(operation.keep, operands[a], operands[b])
+				bitmapResult := operation.op(bitmaps[a], bitmaps[b])
+				if !bitmapResult.isBitmap() {
+					t.Errorf("%s %s %s: bitmaps combined into a sorted set", a, operation.name, b)
+				}
+				results := map[string]*Set{
+					"bitmap":         bitmapResult,
+					"slice":          operation.op(slices[a], slices[b]),
+					"bitmap ∘ slice": operation.op(bitmaps[a], slices[b]),
+					"slice ∘ bitmap": operation.op(slices[a], bitmaps[b]),
+				}
+				for kind, result := range results {
+					checkItems(t, a+" "+operation.name+" "+b+" ("+kind+")", result, want)
+				}
+			}
+
+			checkPredicates(t, a, b, bitmaps[a], bitmaps[b], slices[a], slices[b])
+		}
+	}
+}
+
+func checkItems(t *testing.T, name string, set *Set, want []Item) {
+	t.Helper()
+	got := set.ItemsList()
+	if !sameItems(got, want) {
+		t.Errorf("%s: got %d items, want %d", name, len(got), len(want))
+		return
+	}
+	if set.Length() != int64(len(want)) {
+		t.Errorf("%s: Length() = %d, want %d", name, set.Length(), len(want))
+	}
+}
+
+func sameItems(a []Item, b []Item) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func checkPredicates(t *testing.T, a string, b string, bitmapA, bitmapB, sliceA, sliceB *Set) {
+	t.Helper()
+	predicates := []struct {
+		name string
+		fn   func(*Set, *Set) bool
+	}{
+		{"superset", (*Set).SupersetOf},
+		{"subset", (*Set).SubsetOf},
+		{"disjoint", (*Set).DisjointOf},
+		{"same", (*Set).SameAs},
+	}
+	for _, predicate := range predicates {
+		want := predicate.fn(sliceA, sliceB)
+		if got := predicate.fn(bitmapA, bitmapB); got != want {
+			t.Errorf("%s %s %s: bitmaps = %v, slices = %v", a, predicate.name, b, got, want)
+		}
+		if got := predicate.fn(bitmapA, sliceB); got != want {
+			t.Errorf("%s %s %s: bitmap and slice = %v, slices = %v", a, predicate.name, b, got, want)
+		}
+	}
+}
+
+func TestBitmapMultipleOperands(t *testing.T) {
+	integerSets := integerSets()
+	x, y, z := integerSets["full"], integerSets["span"], integerSets["mixed"]
+	operands := []operand{newOperand(x), newOperand(y), newOperand(z)}
+
+	tests := []struct {
+		name string
+		op   func(...*Set) *Set
+		keep func([]bool) bool
+	}{
+		{"union", Union, inAny},
+		{"intersection", Intersection, inAll},
+		{"difference", Difference, inFirstOnly},
+		{"symmetric difference", SymmetricDifference, inOne},
+	}
+	for _, test := range tests {
+		want := reference(test.keep, operands...)
+		checkItems(t, test.name+" (bitmap)", test.op(asBitmap(x), asBitmap(y), asBitmap(z)), want)
+		checkItems(t, test.name+" (slice)", test.op(asSlice(x), asSlice(y), asSlice(z)), want)
+	}
+}
+
+// TestBitmapManyOperands checks operations combining many small sets, along
+// with a dense one, which are merged at once rather than one at a time.
+func TestBitmapManyOperands(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	integers := [][]int64{}
+	for i := 0; i < 500; i++ {
+		values := make([]int64, 0, 10)
+		for j := 0; j < 10; j++ {
+			values = append(values, rng.Int63n(1<<17))
+		}
+		integers = append(integers, values)
+	}
+	dense := make([]int64, 0, 60000)
+	for i := int64(0); i < 60000; i++ {
+		dense = append(dense, i)
+	}
+
+	tests := []struct {
+		name string
+		op   func(...*Set) *Set
+		keep func([]bool) bool
+	}{
+		{"union", Union, inAny},
+		{"intersection", Intersection, inAll},
+		{"difference", Difference, inFirstOnly},
+		{"symmetric difference", SymmetricDifference, inOne},
+	}
+	for _, withDense := range []bool{false, true} {
+		all := integers
+		if withDense {
+			all = append([][]int64{dense}, integers...)
+		}
+		operands := make([]operand, 0, len(all))
+		bitmaps := make([]*Set, 0, len(all))
+		slices := make([]*Set, 0, len(all))
+		for _, values := range all {
+			operands = append(operands, newOperand(values))
+			bitmaps = append(bitmaps, asBitmap(values))
+			slices = append(slices, asSlice(values))
+		}
+		for _, test := range tests {
+			name := fmt.Sprintf("%s of %d sets", test.name, len(all))
+			want := reference(test.keep, operands...)
+			checkItems(t, name+" (bitmap)", test.op(bitmaps...), want)
+			checkItems(t, name+" (slice)", test.op(slices...), want)
+		}
+	}
+}
+
+func BenchmarkUnionSingletons(b *testing.B) {
+	kinds := map[string]func(int64) Item{
+		"integers": func(i int64) Item { return NewInteger(i) },
+		"strings":  func(i int64) Item { return NewString(fmt.Sprintf("item:%d", i)) },
+	}
+	for name, item := range kinds {
+		operands := make([]*Set, 0, 16000)
+		for i := int64(0); i < 16000; i++ {
+			operands = append(operands, NewSet(item(i)))
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				Union(operands...)
+			}
+		})
+	}
+}
+
+// TestBitmapContainers checks the transitions between array and bitmap
+// containers as integers are added and removed.
+func TestBitmapContainers(t *testing.T) {
+	set := NewSet()
+	for i := int64(0); i < arrayMaxCardinality; i++ {
+		set.Add(NewInteger(i * 2))
+	}
+	if set.integers.containers[0].isBitmap() {
+		t.Fatalf("container of %d integers held as a bitmap", arrayMaxCardinality)
+	}
+	set.Add(NewInteger(1))
+	if !set.integers.containers[0].isBitmap() {
+		t.Fatalf("container of %d integers held as an array", arrayMaxCardinality+1)
+	}
+	if set.Add(NewInteger(1)) {
+		t.Errorf("Add(1) twice returned true")
+	}
+	set.Remove(NewInteger(1))
+	if set.integers.containers[0].isBitmap() {
+		t.Fatalf("container of %d integers held as a bitmap after removal", arrayMaxCardinality)
+	}
+	if set.Length() != arrayMaxCardinality {
+		t.Errorf("Length() = %d, want %d", set.Length(), arrayMaxCardinality)
+	}
+	for i := int64(0); i < 10; i++ {
+		if set.Contains(NewInteger(i)) != (i%2 == 0) {
+			t.Errorf("Contains(%d) = %v", i, !(i%2 == 0))
+		}
+	}
+
+	for i := int64(0); i < arrayMaxCardinality; i++ {
+		set.Remove(NewInteger(i * 2))
+	}
+	if len(set.integers.containers) != 0 {
+		t.Errorf("%d containers left once empty", len(set.integers.containers))
+	}
+
+	// a set holding anything but integers is no longer a bitmap
+	set = asBitmap([]int64{3, 1, 2})
+	set.Add(NewString("a"))
+	if set.isBitmap() {
+		t.Fatalf("set holding a string is a bitmap")
+	}
+	want := []Item{NewInteger(1), NewInteger(2), NewInteger(3), NewString("a")}
+	checkItems(t, "mixed", set, want)
+	if !Intersection(set, asBitmap([]int64{2, 3, 4})).isBitmap() {
+		t.Errorf("intersection holding integers only is not a bitmap")
+	}
+}
+
+func TestBitmapIterator(t *testing.T) {
+	for name, integers := range integerSets() {
+		set := asBitmap(integers)
+		want := set.ItemsList()
+
+		it := set.Iterator()
+		got := make([]Item, 0, len(want))
+		for {
+			item, ok := it.Next()
+			if !ok {
+				break
+			}
+			got = append(got, item)
+		}
+		it.Close()
+		if !sameItems(got, want) {
+			t.Errorf("%s: iterated over %d items, want %d", name, len(got), len(want))
+		}
+
+		for _, n := range []int64{0, 1, 100, 5000, int64(len(want))} {
+			if n > int64(len(want)) {
+				continue
+			}
+			it := set.Iterator()
+			it.Skip(n)
+			item, ok := it.Next()
+			if ok != (n < int64(len(want))) || (ok && item != want[n]) {
+				t.Errorf("%s: Skip(%d) then Next() = %v, %v", name, n, item, ok)
+			}
+			it.Close()
+		}
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// bloomFalsePositiveRate is the rate a filter is sized for, ~9.6 bits per
+// item.
+const bloomFalsePositiveRate = 0.01
+
+// BloomFilter tells whether an item may be part of a set or definitely
+// isn't, it is sized for a number of items and a false positive rate.
+type BloomFilter struct {
+	words  []uint64
+	hashes uint8
+}
+
+func NewBloomFilter(items int) *BloomFilter {
+	bits := math.Ceil(-float64(items) * math.Log(bloomFalsePositiveRate) / (math.Ln2 * math.Ln2))
+	words := int(math.Ceil(bits / 64))
+	if words == 0 {
+		words = 1
+	}
+
+	hashes := 1
+	if items != 0 {
+		hashes = int(math.Round(float64(words*64) / float64(items) * math.Ln2))
+	}
+	if hashes < 1 {
+		hashes = 1
+	} else if hashes > 16 {
+		hashes = 16
+	}
+	return &BloomFilter{
+		words:  make([]uint64, words),
+		hashes: uint8(hashes),
+	}
+}
+
+// Filter returns a BloomFilter holding the items of the set.
+func (s *Set) Filter() *BloomFilter {
+	f := NewBloomFilter(int(s.Length()))
+	it := s.Iterator()
+	defer it.Close()
+	for {
+		item, ok := it.Next()
+		if !ok {
+			return f
+		}
+		f.Add(item)
+	}
+}
+
+func (f *BloomFilter) Add(item Item) {
+	f.AddLiteral(item.String())
+}
+
+// AddLiteral adds an item given in its literal form, as
+// HyperLogLog.AddLiteral does.
+func (f *BloomFilter) AddLiteral(literal string) {
+	f.each(literal, func(word int, bit uint64) bool {
+		f.words[word] |= bit
+		return true
+	})
+}
+
+// MayContain returns false if item was never added, true if it probably was.
+func (f *BloomFilter) MayContain(item Item) bool {
+	return f.MayContainLiteral(item.String())
+}
+
+// MayContainLiteral is MayContain for an item given in its literal form.
+func (f *BloomFilter) MayContainLiteral(literal string) bool {
+	return f.each(literal, func(word int, bit uint64) bool {
+		return f.words[word]&bit != 0
+	})
+}
+
+// each calls fn with the position of every bit of an item until it returns
+// false, positions are derived from two hashes.
+func (f *BloomFilter) each(literal string, fn func(int, uint64) bool) bool {
+	bits := uint64(len(f.words)) * 64
+	h1 := hashLiteral(literal)
+	h2 := mix(h1) | 1
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		position := (h1 + i*h2) % bits
+		if !fn(int(position/64), 1<<(position%64)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *BloomFilter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 1, 1+8*len(f.words))
+	data[0] = f.hashes
+	for _, word := range f.words {
+		data = binary.LittleEndian.AppendUint64(data, word)
+	}
+	return data, nil
+}
+
+func (f *BloomFilter) UnmarshalBinary(data []byte) error {
+	if len(data) < 9 || (len(data)-1)%8 != 0 || data[0] == 0 {
+		return fmt.Errorf("invalid filter")
+	}
+	f.hashes = data[0]
+	f.words = make([]uint64, 0, (len(data)-1)/8)
+	for i := 1; i < len(data); i += 8 {
+		f.words = append(f.words, binary.LittleEndian.Uint64(data[i:]))
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sets
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		count int
+		item  func(int) Item
+	}{
+		{"integers", 0, func(i int) Item { return NewInteger(int64(i)) }},
+		{"integers", 1, func(i int) Item { return NewInteger(int64(i)) }},
+		{"integers", 100, func(i int) Item { return NewInteger(int64(i)) }},
+		{"integers", 20000, func(i int) Item { return NewInteger(int64(i)) }},
+		{"strings", 20000, func(i int) Item { return NewString(fmt.Sprintf("user:%d", i)) }},
+	}
+
+	for _, test := range tests {
+		set := NewSet()
+		for i := 0; i < test.count; i++ {
+			set.Add(test.item(i))
+		}
+		f := set.Filter()
+
+		// every item added is reported, as an item and as a literal
+		for i := 0; i < test.count; i++ {
+			item := test.item(i)
+			if !f.MayContain(item) || !f.MayContainLiteral(item.String()) {
+				t.Fatalf("%d %s: %s not found", test.count, test.name, item)
+			}
+		}
+
+		// items never added are rarely reported, allow twice the rate the
+		// filter is sized for
+		const probes = 20000
+		positives := 0
+		for i := test.count; i < test.count+probes; i++ {
+			if f.MayContain(test.item(i)) {
+				positives++
+			}
+		}
+		if rate := float64(positives) / probes; rate > 2*bloomFalsePositiveRate {
+			t.Errorf("%d %s: false positive rate %.4f, want %.2f", test.count, test.name, rate, bloomFalsePositiveRate)
+		}
+	}
+}
+
+func TestBloomFilterLiteral(t *testing.T) {
+	float, _ := NewFloat(1.5)
+	items := []Item{NewInteger(42), NewString("42"), NewBoolean(true), float}
+
+	for _, item := range items {
+		a, b := NewBloomFilter(1), NewBloomFilter(1)
+		a.Add(item)
+		b.AddLiteral(item.String())
+		if fmt.Sprint(a.words) != fmt.Sprint(b.words) {
+			t.Errorf("%s: Add and AddLiteral differ", item)
+		}
+	}
+
+	// an integer and the string of its digits are different items
+	f := NewBloomFilter(1)
+	f.Add(NewInteger(42))
+	if f.MayContain(NewString("42")) {
+		t.Errorf("filter of 42 holds '42'")
+	}
+}
+
+func TestBloomFilterBinary(t *testing.T) {
+	for _, count := range []int{0, 1, 1000} {
+		set := NewSet()
+		for i := 0; i < count; i++ {
+			set.Add(NewInteger(int64(i)))
+		}
+		f := set.Filter()
+		data, err := f.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded := &BloomFilter{}
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("%d items: %v", count, err)
+		}
+		if decoded.hashes != f.hashes || fmt.Sprint(decoded.words) != fmt.Sprint(f.words) {
+			t.Errorf("%d items: decoded filter differs", count)
+		}
+		for i := 0; i < count; i++ {
+			if !decoded.MayContain(NewInteger(int64(i))) {
+				t.Fatalf("%d items: %d not found once decoded", count, i)
+			}
+		}
+		if again, _ := decoded.MarshalBinary(); string(again) != string(data) {
+			t.Errorf("%d items: decoded filter marshals differently", count)
+		}
+	}
+
+	data, _ := NewSet().Filter().MarshalBinary()
+	invalid := [][]byte{
+		nil,
+		{1},
+		append([]byte{0}, data[1:]...),
+		data[:len(data)-1],
+		append(append([]byte(nil), data...), 0),
+	}
+	for _, data := range invalid {
+		if err := (&BloomFilter{}).UnmarshalBinary(data); err == nil {
+			t.Errorf("UnmarshalBinary(%v) succeeded", data)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sets
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// sketchPrecision is the number of bits of a hash selecting a register, the
+// standard error of an estimate is 1.04 / sqrt(2^sketchPrecision), ~0.8%.
+const sketchPrecision = 14
+
+const sketchRegisters = 1 << sketchPrecision
+
+// HyperLogLog estimates the number of distinct items added to it in a fixed
+// amount of memory, sketches of different sets can be merged to estimate
+// the cardinality of their union.
+type HyperLogLog struct {
+	registers []uint8
+}
+
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{
+		registers: make([]uint8, sketchRegisters),
+	}
+}
+
+// Sketch returns a HyperLogLog holding the items of the set.
+func (s *Set) Sketch() *HyperLogLog {
+	h := NewHyperLogLog()
+	it := s.Iterator()
+	defer it.Close()
+	for {
+		item, ok := it.Next()
+		if !ok {
+			return h
+		}
+		h.Add(item)
+	}
+}
+
+func (h *HyperLogLog) Add(item Item) {
+	h.AddLiteral(item.String())
+}
+
+// AddLiteral adds an item given in its literal form, as returned by
+// Item.String, which is how backends receive them.
+func (h *HyperLogLog) AddLiteral(literal string) {
+	x := hashLiteral(literal)
+
+	register := x >> (64 - sketchPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<sketchPrecision|1<<(sketchPrecision-1))) + 1
+	if rank > h.registers[register] {
+		h.registers[register] = rank
+	}
+}
+
+// hashLiteral hashes the literal form of an item, FNV bits being spread
+// as its high bits are poorly distributed for short inputs.
+func hashLiteral(literal string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(literal))
+	return mix(hash.Sum64())
+}
+
+func mix(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Merge adds the items of another sketch to this one.
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, rank := range other.registers {
+		if rank > h.registers[i] {
+			h.registers[i] = rank
+		}
+	}
+}
+
+func (h *HyperLogLog) Clone() *HyperLogLog {
+	return &HyperLogLog{
+		registers: append([]uint8(nil), h.registers...),
+	}
+}
+
+// Count returns the estimated number of distinct items added.
+func (h *HyperLogLog) Count() float64 {
+	m := float64(sketchRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// small cardinalities are better estimated by linear counting
+	if estimate <= 2.5*m && zeros != 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
+
+func (h *HyperLogLog) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, 1+len(h.registers))
+	data = append(data, sketchPrecision)
+	return append(data, h.registers...), nil
+}
+
+func (h *HyperLogLog) UnmarshalBinary(data []byte) error {
+	if len(data) != 1+sketchRegisters || data[0] != sketchPrecision {
+		return fmt.Errorf("invalid sketch")
+	}
+	h.registers = append([]uint8(nil), data[1:]...)
+	return nil
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sets
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// sketchTolerance is the relative error accepted from an estimate, three
+// times the standard error.
+var sketchTolerance = 3 * 1.04 / math.Sqrt(sketchRegisters)
+
+func TestHyperLogLogCount(t *testing.T) {
+	tests := []struct {
+		name  string
+		count int
+		item  func(int) Item
+	}{
+		{"integers", 0, func(i int) Item { return NewInteger(int64(i)) }},
+		{"integers", 1, func(i int) Item { return NewInteger(int64(i)) }},
+		{"integers", 100, func(i int) Item { return NewInteger(int64(i)) }},
+		{"integers", 10000, func(i int) Item { return NewInteger(int64(i)) }},
+		{"integers", 50000, func(i int) Item { return NewInteger(int64(i)) }},
+		{"integers", 500000, func(i int) Item { return NewInteger(int64(i)) }},
+		{"strings", 30000, func(i int) Item { return NewString(fmt.Sprintf("user:%d", i)) }},
+	}
+
+	for _, test := range tests {
+		h := NewHyperLogLog()
+		for i := 0; i < test.count; i++ {
+			h.Add(test.item(i))
+			// duplicates are not counted
+			h.Add(test.item(i))
+		}
+		checkEstimate(t, fmt.Sprintf("%d %s", test.count, test.name), h.Count(), float64(test.count))
+	}
+}
+
+func checkEstimate(t *testing.T, name string, got float64, want float64) {
+	t.Helper()
+	if math.Abs(got-want) > want*sketchTolerance {
+		t.Errorf("%s: estimated %.0f, want %.0f ± %.1f%%", name, got, want, 100*sketchTolerance)
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	a, b := NewSet(), NewSet()
+	for i := int64(0); i < 20000; i++ {
+		a.Add(NewInteger(i))
+		b.Add(NewInteger(i + 15000))
+	}
+	b.Add(NewString("a"))
+
+	merged := a.Sketch().Clone()
+	merged.Merge(b.Sketch())
+	if got, want := merged.Count(), Union(a, b).Sketch().Count(); got != want {
+		t.Errorf("merged sketches estimate %f, sketch of the union %f", got, want)
+	}
+	checkEstimate(t, "merged", merged.Count(), 35001)
+
+	// merging doesn't modify the merged sketch, nor cloning the original
+	clone := a.Sketch()
+	before := clone.Count()
+	clone.Clone().Merge(b.Sketch())
+	if clone.Count() != before {
+		t.Errorf("merging into a clone modified the original")
+	}
+}
+
+func TestHyperLogLogLiteral(t *testing.T) {
+	items := []Item{NewInteger(42), NewString("42"), NewBoolean(true), NewString("café")}
+	float, _ := NewFloat(42)
+	items = append(items, float)
+
+	for _, item := range items {
+		a, b := NewHyperLogLog(), NewHyperLogLog()
+		a.Add(item)
+		b.AddLiteral(item.String())
+		if a.Count() != b.Count() || fmt.Sprint(a.registers) != fmt.Sprint(b.registers) {
+			t.Errorf("%s: Add and AddLiteral differ", item)
+		}
+	}
+
+	// items of different types are different items
+	h := NewHyperLogLog()
+	for _, item := range items {
+		h.Add(item)
+	}
+	checkEstimate(t, "typed items", h.Count(), float64(len(items)))
+}
+
+func TestHyperLogLogBinary(t *testing.T) {
+	h := NewHyperLogLog()
+	for i := int64(0); i < 1000; i++ {
+		h.Add(NewInteger(i))
+	}
+	data, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := NewHyperLogLog()
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Count() != h.Count() {
+		t.Errorf("decoded sketch estimates %f, want %f", decoded.Count(), h.Count())
+	}
+
+	// the decoded sketch doesn't share the serialized data
+	data[1]++
+	if decoded.Count() != h.Count() {
+		t.Errorf("decoded sketch modified along its serialized form")
+	}
+
+	invalid := [][]byte{
+		nil,
+		{sketchPrecision},
+		data[:len(data)-1],
+		append(append([]byte(nil), data...), 0),
+		append([]byte{sketchPrecision + 1}, data[1:]...),
+	}
+	for _, data := range invalid {
+		if err := NewHyperLogLog().UnmarshalBinary(data); err == nil {
+			t.Errorf("UnmarshalBinary of %d bytes succeeded", len(data))
+		}
+	}
+}
@@ -0,0 +1,280 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sets
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+// Type is the type of an item, items of different types are never equal.
+type Type int
+
+const (
+	StringType Type = iota
+	IntegerType
+	FloatType
+	BooleanType
+)
+
+var types = []string{
+	StringType:  "string",
+	IntegerType: "integer",
+	FloatType:   "float",
+	BooleanType: "boolean",
+}
+
+func (t Type) String() string {
+	return types[t]
+}
+
+// ParseType returns the type named name, as written in a query.
+func ParseType(name string) (Type, error) {
+	for t, typeName := range types {
+		if strings.EqualFold(name, typeName) {
+			return Type(t), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown type: %s", name)
+}
+
+// Item is a typed value, it is comparable and can be used as a map key.
+// Booleans are held as integers, 0 being false.
+type Item struct {
+	typ     Type
+	text    string
+	integer int64
+	float   float64
+}
+
+func NewString(value string) Item {
+	return Item{typ: StringType, text: value}
+}
+
+func NewInteger(value int64) Item {
+	return Item{typ: IntegerType, integer: value}
+}
+
+// NewFloat returns a float item, infinities and NaN are not items as they
+// can't be written in a query nor compared.
+func NewFloat(value float64) (Item, error) {
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return Item{}, fmt.Errorf("invalid float: %v", value)
+	}
+	// -0 and 0 are the same item
+	if value == 0 {
+		value = 0
+	}
+	return Item{typ: FloatType, float: value}, nil
+}
+
+func NewBoolean(value bool) Item {
+	if value {
+		return Item{typ: BooleanType, integer: 1}
+	}
+	return Item{typ: BooleanType}
+}
+
+func (i Item) Type() Type {
+	return i.typ
+}
+
+// IsNumber returns true if the item is an integer or a float.
+func (i Item) IsNumber() bool {
+	return i.typ == IntegerType || i.typ == FloatType
+}
+
+// Integer returns the value of an integer item.
+func (i Item) Integer() int64 {
+	return i.integer
+}
+
+// Float returns the value of a number, integers being converted.
+func (i Item) Float() float64 {
+	if i.typ == IntegerType {
+		return float64(i.integer)
+	}
+	return i.float
+}
+
+// Boolean returns the value of a boolean item.
+func (i Item) Boolean() bool {
+	return i.integer != 0
+}
+
+// Text returns the value of an item as text, without quotes for strings.
+func (i Item) Text() string {
+	switch i.typ {
+	case IntegerType:
+		return strconv.FormatInt(i.integer, 10)
+	case FloatType:
+		text := strconv.FormatFloat(i.float, 'g', -1, 64)
+		// floats keep a fractional part so they are not read back as integers
+		if !strings.ContainsAny(text, ".e") {
+			text += ".0"
+		}
+		return text
+	case BooleanType:
+		return strconv.FormatBool(i.Boolean())
+	default:
+		return i.text
+	}
+}
+
+// String returns the item as written in a query: strings are quoted, other
+// types are written as is. This is the form items are persisted in.
+func (i Item) String() string {
+	if i.typ == StringType {
+		return Quote(i.text)
+	}
+	return i.Text()
+}
+
+// Compare orders items by type then by value: booleans, false first, come
+// before numbers, ordered numerically with integers first on ties, which
+// come before strings, ordered lexicographically.
+func Compare(a Item, b Item) int {
+	if rank(a) != rank(b) {
+		return compareInt(int64(rank(a)), int64(rank(b)))
+	}
+
+	switch a.typ {
+	case StringType:
+		return strings.Compare(a.text, b.text)
+	case BooleanType:
+		return compareInt(a.integer, b.integer)
+	}
+
+	if a.typ == IntegerType && b.typ == IntegerType {
+		return compareInt(a.integer, b.integer)
+	}
+	switch x, y := a.Float(), b.Float(); {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return compareInt(int64(a.typ), int64(b.typ))
+}
+
+func rank(i Item) int {
+	switch i.typ {
+	case BooleanType:
+		return 0
+	case IntegerType, FloatType:
+		return 1
+	default:
+		return 2
+	}
+}
+
+func compareInt(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Sort orders items with Compare.
+func Sort(items []Item) {
+	sort.Slice(items, func(i, j int) bool {
+		return Compare(items[i], items[j]) < 0
+	})
+}
+
+// MarshalJSON encodes items as the matching JSON type, floats always hold
+// a fractional part or an exponent so they are told apart from integers.
+func (i Item) MarshalJSON() ([]byte, error) {
+	if i.typ == StringType {
+		return json.Marshal(i.text)
+	}
+	return []byte(i.Text()), nil
+}
+
+func (i *Item) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+
+	switch value := value.(type) {
+	case string:
+		*i = NewString(value)
+	case bool:
+		*i = NewBoolean(value)
+	case json.Number:
+		item, err := ParseNumber(value.String())
+		if err != nil {
+			return err
+		}
+		*i = item
+	default:
+		return fmt.Errorf("invalid item: %s", string(data))
+	}
+	return nil
+}
+
+// ParseNumber returns the integer or float item written as text, a number
+// with a fractional part or an exponent is a float.
+func ParseNumber(text string) (Item, error) {
+	if !strings.ContainsAny(text, ".eE") {
+		value, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return Item{}, fmt.Errorf("invalid integer: %s", text)
+		}
+		return NewInteger(value), nil
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return Item{}, fmt.Errorf("invalid float: %s", text)
+	}
+	return NewFloat(value)
+}
+
+// Quote returns a string as a single quoted literal, with quotes,
+// backslashes and non-printable characters escaped.
+func Quote(s string) string {
+	var buf strings.Builder
+	buf.WriteByte('\'')
+	for _, r := range s {
+		switch {
+		case r == '\'' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case unicode.IsPrint(r):
+			buf.WriteRune(r)
+		default:
+			for _, u := range utf16.Encode([]rune{r}) {
+				fmt.Fprintf(&buf, "\\u%04x", u)
+			}
+		}
+	}
+	buf.WriteByte('\'')
+	return buf.String()
+}
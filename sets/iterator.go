@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sets
+
+import "math"
+
+// Iterator walks the items of a set in the order defined by Compare
+// without materializing them, the set must not be modified meanwhile.
+type Iterator struct {
+	integers *cursor
+	items    []Item
+	pos      int
+
+	peeked  Item
+	hasPeek bool
+	closed  bool
+}
+
+func (s *Set) Iterator() *Iterator {
+	s.muItems.Lock()
+	defer s.muItems.Unlock()
+
+	if s.isBitmap() {
+		return &Iterator{integers: s.integers.cursor()}
+	}
+	return &Iterator{items: s.sorted()}
+}
+
+// Next returns the next item, or false once the iterator is exhausted or
+// closed.
+func (it *Iterator) Next() (Item, bool) {
+	if it.closed {
+		return Item{}, false
+	}
+	if it.hasPeek {
+		it.hasPeek = false
+		return it.peeked, true
+	}
+	if it.integers != nil {
+		value, ok := it.integers.next()
+		if !ok {
+			return Item{}, false
+		}
+		return NewInteger(value), true
+	}
+	if it.pos == len(it.items) {
+		return Item{}, false
+	}
+	it.pos++
+	return it.items[it.pos-1], true
+}
+
+// Seek moves the iterator so that Next returns the first item greater than
+// or equal to item, whatever the current position.
+func (it *Iterator) Seek(item Item) {
+	if it.closed {
+		return
+	}
+	it.hasPeek = false
+	if it.integers == nil {
+		it.pos, _ = search(it.items, item)
+		return
+	}
+
+	// integers sort between booleans and strings and may compare equal to
+	// a float as a float64, seek to a lower bound and walk from there
+	switch {
+	case item.Type() == BooleanType:
+		it.integers.seek(math.MinInt64)
+		return
+	case item.Type() == StringType, item.IsNumber() && item.Float() >= math.MaxInt64:
+		it.integers.end()
+		return
+	case item.Type() == IntegerType:
+		it.integers.seek(item.Integer())
+		return
+	case item.Float() < math.MinInt64:
+		it.integers.seek(math.MinInt64)
+		return
+	}
+	it.integers.seek(int64(math.Floor(item.Float())))
+	for {
+		next, ok := it.Next()
+		if !ok {
+			return
+		}
+		if Compare(next, item) >= 0 {
+			it.peeked, it.hasPeek = next, true
+			return
+		}
+	}
+}
+
+// Skip moves the iterator past n items and returns how many were skipped,
+// which is less than n once the iterator is exhausted.
+func (it *Iterator) Skip(n int64) int64 {
+	if it.closed || n <= 0 {
+		return 0
+	}
+	var skipped int64
+	if it.hasPeek {
+		it.hasPeek = false
+		skipped++
+	}
+	if it.integers != nil {
+		return skipped + it.integers.skip(n-skipped)
+	}
+	remaining := int64(len(it.items) - it.pos)
+	if n-skipped < remaining {
+		remaining = n - skipped
+	}
+	it.pos += int(remaining)
+	return skipped + remaining
+}
+
+// Close releases the set, Next returns false from then on.
+func (it *Iterator) Close() error {
+	it.closed = true
+	it.integers = nil
+	it.items = nil
+	return nil
+}
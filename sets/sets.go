@@ -16,95 +16,303 @@
 
 package sets
 
-import "sync"
-
+import (
+	"container/heap"
+	"sync"
+)
+
+// Set holds items sorted with Compare, or in a compressed bitmap as long as
+// all of them are integers. Sets start as bitmaps and switch to a sorted
+// slice once an item of another type is added, set operations are linear
+// merges of the sorted items of their operands.
+//
+// Items added to a sorted set are buffered in pending until the set is
+// read, so that building a set item by item doesn't shift the slice on
+// every insertion.
 type Set struct {
-	items   map[string]struct{}
-	muItems sync.Mutex
+	items    []Item
+	pending  map[Item]struct{}
+	integers *bitmap
+	muItems  sync.Mutex
+}
+
+func NewSet(items ...Item) *Set {
+	set := &Set{
+		integers: newBitmap(),
+	}
+	for _, item := range items {
+		set.add(item)
+	}
+	return set
 }
 
-func NewSet(items ...string) *Set {
-	itemsMap := make(map[string]struct{})
+// newSortedSet returns a set holding items, which are sorted and unique,
+// integers are moved to a bitmap if there is nothing else.
+func newSortedSet(items []Item) *Set {
 	for _, item := range items {
-		itemsMap[item] = struct{}{}
+		if item.Type() != IntegerType {
+			return &Set{items: items}
+		}
 	}
-	return &Set{
-		items: itemsMap,
+	integers := newBitmap()
+	for _, item := range items {
+		integers.add(item.Integer())
 	}
+	return &Set{integers: integers}
 }
 
-func Union(sets ...*Set) *Set {
-	Set := NewSet()
-	for _, set := range sets {
-		items := set.items
-		for item := range items {
-			Set.items[item] = struct{}{}
+func (s *Set) isBitmap() bool {
+	return s.integers != nil
+}
+
+// sorted returns the items of the set in order, the slice must not be
+// modified.
+func (s *Set) sorted() []Item {
+	if s.isBitmap() {
+		items := make([]Item, 0, s.integers.cardinality())
+		s.integers.each(func(value int64) bool {
+			items = append(items, NewInteger(value))
+			return true
+		})
+		return items
+	}
+	s.flush()
+	return s.items
+}
+
+// flush merges the pending items into the sorted ones.
+func (s *Set) flush() {
+	if len(s.pending) == 0 {
+		return
+	}
+	pending := make([]Item, 0, len(s.pending))
+	for item := range s.pending {
+		pending = append(pending, item)
+	}
+	Sort(pending)
+	s.items = mergeItems(s.items, pending, true, true, true)
+	s.pending = nil
+}
+
+func (s *Set) add(item Item) bool {
+	if s.isBitmap() {
+		if item.Type() == IntegerType {
+			return s.integers.add(item.Integer())
 		}
+		s.items = s.sorted()
+		s.integers = nil
+	}
+	if s.contains(item) {
+		return false
+	}
+	if s.pending == nil {
+		s.pending = make(map[Item]struct{})
 	}
-	return Set
+	s.pending[item] = struct{}{}
+	return true
 }
 
-func Intersection(sets ...*Set) *Set {
-	intersectionMap := make(map[string]int)
-	for _, set := range sets {
-		items := set.items
-		for item := range items {
-			intersectionMap[item] += 1
+func (s *Set) contains(item Item) bool {
+	if s.isBitmap() {
+		return item.Type() == IntegerType && s.integers.contains(item.Integer())
+	}
+	if _, found := search(s.items, item); found {
+		return true
+	}
+	_, exists := s.pending[item]
+	return exists
+}
+
+func (s *Set) length() int64 {
+	if s.isBitmap() {
+		return s.integers.cardinality()
+	}
+	// pending items are never part of the sorted ones
+	return int64(len(s.items) + len(s.pending))
+}
+
+// search returns the position of item in sorted items, or where it would
+// be inserted.
+func search(items []Item, item Item) (int, bool) {
+	lo, hi := 0, len(items)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if Compare(items[mid], item) < 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
 		}
 	}
+	return lo, lo < len(items) && Compare(items[lo], item) == 0
+}
 
-	Set := NewSet()
-	for k := range intersectionMap {
-		if intersectionMap[k] == len(sets) {
-			Set.items[k] = struct{}{}
+// mergeItems walks two sorted slices of items in a single pass and keeps the
+// items only found in a, only found in b, or found in both as requested.
+func mergeItems(a []Item, b []Item, onlyA bool, onlyB bool, both bool) []Item {
+	ret := make([]Item, 0)
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch cmp := Compare(a[i], b[j]); {
+		case cmp < 0:
+			if onlyA {
+				ret = append(ret, a[i])
+			}
+			i++
+		case cmp > 0:
+			if onlyB {
+				ret = append(ret, b[j])
+			}
+			j++
+		default:
+			if both {
+				ret = append(ret, a[i])
+			}
+			i++
+			j++
 		}
 	}
-	return Set
+	if onlyA {
+		ret = append(ret, a[i:]...)
+	}
+	if onlyB {
+		ret = append(ret, b[j:]...)
+	}
+	return ret
 }
 
-func Difference(sets ...*Set) *Set {
-	sourceSet := sets[0]
-	Set := NewSet()
-	for item := range sourceSet.items {
-		Set.items[item] = struct{}{}
-	}
-	for _, set := range sets[1:] {
-		items := set.items
-		for item := range items {
-			delete(Set.items, item)
+// cursors walks the sorted items of several sets at once, ordered by their
+// next item.
+type cursors []*itemCursor
+
+type itemCursor struct {
+	items   []Item
+	operand int
+}
+
+func (c cursors) Len() int           { return len(c) }
+func (c cursors) Less(i, j int) bool { return Compare(c[i].items[0], c[j].items[0]) < 0 }
+func (c cursors) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+func (c *cursors) Push(x any) {
+	*c = append(*c, x.(*itemCursor))
+}
+
+func (c *cursors) Pop() any {
+	old := *c
+	ret := old[len(old)-1]
+	*c = old[:len(old)-1]
+	return ret
+}
+
+// countItems merges the sorted items of sets in a single pass and keeps the
+// items accepted by keep, given the number of sets holding an item and
+// whether the first one does.
+func countItems(sets []*Set, keep func(count int, first bool) bool) []Item {
+	c := make(cursors, 0, len(sets))
+	for i, set := range sets {
+		if items := set.ItemsList(); len(items) != 0 {
+			c = append(c, &itemCursor{items: items, operand: i})
+		}
+	}
+	heap.Init(&c)
+
+	ret := make([]Item, 0)
+	for len(c) != 0 {
+		item := c[0].items[0]
+		count, first := 0, false
+		for len(c) != 0 && Compare(c[0].items[0], item) == 0 {
+			count++
+			first = first || c[0].operand == 0
+			if c[0].items = c[0].items[1:]; len(c[0].items) == 0 {
+				heap.Pop(&c)
+			} else {
+				heap.Fix(&c, 0)
+			}
+		}
+		if keep(count, first) {
+			ret = append(ret, item)
 		}
 	}
-	return Set
+	return ret
 }
 
-func SymmetricDifference(sets ...*Set) *Set {
-	intersectionMap := make(map[string]int)
+// bitmaps returns the bitmaps of sets if all of them are held as bitmaps.
+func bitmaps(sets []*Set) ([]*bitmap, bool) {
+	ret := make([]*bitmap, 0, len(sets))
 	for _, set := range sets {
-		for item := range set.items {
-			intersectionMap[item] += 1
+		if !set.isBitmap() {
+			return nil, false
 		}
+		ret = append(ret, set.integers)
 	}
+	return ret, true
+}
 
-	Set := NewSet()
-	for k := range intersectionMap {
-		if intersectionMap[k] == 1 {
-			Set.items[k] = struct{}{}
+func Union(sets ...*Set) *Set {
+	if integers, ok := bitmaps(sets); ok {
+		return &Set{integers: unionBitmaps(integers...)}
+	}
+
+	return newSortedSet(countItems(sets, func(count int, first bool) bool {
+		return true
+	}))
+}
+
+func Intersection(sets ...*Set) *Set {
+	if len(sets) == 0 {
+		return NewSet()
+	}
+	if integers, ok := bitmaps(sets); ok {
+		return &Set{integers: intersectionBitmaps(integers...)}
+	}
+
+	for _, set := range sets {
+		if set.Length() == 0 {
+			return NewSet()
 		}
 	}
-	return Set
+	return newSortedSet(countItems(sets, func(count int, first bool) bool {
+		return count == len(sets)
+	}))
 }
 
-func (s *Set) Items() map[string]struct{} {
-	return s.items
+func Difference(sets ...*Set) *Set {
+	if integers, ok := bitmaps(sets); ok {
+		return &Set{integers: differenceBitmaps(integers...)}
+	}
+
+	return newSortedSet(countItems(sets, func(count int, first bool) bool {
+		return first && count == 1
+	}))
+}
+
+// SymmetricDifference keeps the items found in exactly one of the sets.
+func SymmetricDifference(sets ...*Set) *Set {
+	if integers, ok := bitmaps(sets); ok {
+		return &Set{integers: symmetricDifferenceBitmaps(integers...)}
+	}
+
+	return newSortedSet(countItems(sets, func(count int, first bool) bool {
+		return count == 1
+	}))
 }
 
-func (s *Set) ItemsList() []string {
+func (s *Set) Items() map[Item]struct{} {
+	items := make(map[Item]struct{})
+	for _, item := range s.ItemsList() {
+		items[item] = struct{}{}
+	}
+	return items
+}
+
+// ItemsList returns the items of the set sorted with Compare.
+func (s *Set) ItemsList() []Item {
 	s.muItems.Lock()
 	defer s.muItems.Unlock()
 
-	items := make([]string, 0)
-	for item := range s.items {
-		items = append(items, item)
+	items := s.sorted()
+	if !s.isBitmap() {
+		items = append([]Item(nil), items...)
 	}
 	return items
 }
@@ -112,7 +320,7 @@ func (s *Set) ItemsList() []string {
 func (s *Set) Length() int64 {
 	s.muItems.Lock()
 	defer s.muItems.Unlock()
-	return int64(len(s.items))
+	return s.length()
 }
 
 func (s *Set) Union(sets ...*Set) *Set {
@@ -143,55 +351,52 @@ func (s *Set) SymmetricDifference(sets ...*Set) *Set {
 	return SymmetricDifference(params...)
 }
 
-func (s *Set) Contains(value string) bool {
-	if _, exists := s.items[value]; !exists {
-		return false
-	} else {
-		return true
-	}
+func (s *Set) Contains(value Item) bool {
+	s.muItems.Lock()
+	defer s.muItems.Unlock()
+
+	return s.contains(value)
 }
 
-func (s *Set) Add(value string) bool {
+func (s *Set) Add(value Item) bool {
 	s.muItems.Lock()
 	defer s.muItems.Unlock()
 
-	if _, exists := s.items[value]; !exists {
-		s.items[value] = struct{}{}
-		return true
-	} else {
-		return false
-	}
+	return s.add(value)
 }
 
-func (s *Set) Remove(value string) bool {
+func (s *Set) Remove(value Item) bool {
 	s.muItems.Lock()
 	defer s.muItems.Unlock()
 
-	if _, exists := s.items[value]; exists {
-		delete(s.items, value)
+	if s.isBitmap() {
+		return value.Type() == IntegerType && s.integers.remove(value.Integer())
+	}
+	if _, exists := s.pending[value]; exists {
+		delete(s.pending, value)
 		return true
-	} else {
-		return false
 	}
-}
-
-func (s *Set) SupersetOf(target *Set) bool {
-	if len(s.items) <= len(target.items) {
+	i, found := search(s.items, value)
+	if !found {
 		return false
 	}
+	s.items = append(s.items[:i], s.items[i+1:]...)
+	return true
+}
 
-	sourceMap := make(map[string]struct{})
-	for item := range s.items {
-		sourceMap[item] = struct{}{}
+// containsAll returns true if every item of target is part of s.
+func (s *Set) containsAll(target *Set) bool {
+	if s.isBitmap() && target.isBitmap() {
+		return target.integers.difference(s.integers).cardinality() == 0
 	}
+	return len(mergeItems(target.ItemsList(), s.ItemsList(), true, false, false)) == 0
+}
 
-	for item := range target.items {
-		if _, exists := sourceMap[item]; !exists {
-			return false
-		}
+func (s *Set) SupersetOf(target *Set) bool {
+	if s.Length() <= target.Length() {
+		return false
 	}
-
-	return true
+	return s.containsAll(target)
 }
 
 func (s *Set) SubsetOf(target *Set) bool {
@@ -199,52 +404,15 @@ func (s *Set) SubsetOf(target *Set) bool {
 }
 
 func (s *Set) DisjointOf(target *Set) bool {
-	sourceMap := make(map[string]struct{})
-	for item := range s.items {
-		sourceMap[item] = struct{}{}
+	if s.isBitmap() && target.isBitmap() {
+		return s.integers.intersection(target.integers).cardinality() == 0
 	}
-
-	targetMap := make(map[string]struct{})
-	for item := range target.items {
-		targetMap[item] = struct{}{}
-	}
-
-	if len(s.items) < len(target.items) {
-		for item := range s.items {
-			if _, exists := targetMap[item]; exists {
-				return false
-			}
-		}
-	} else {
-		for item := range target.items {
-			if _, exists := sourceMap[item]; exists {
-				return false
-			}
-		}
-	}
-	return true
+	return len(mergeItems(s.ItemsList(), target.ItemsList(), false, false, true)) == 0
 }
 
 func (s *Set) SameAs(target *Set) bool {
-	if len(s.items) != len(target.items) {
+	if s.Length() != target.Length() {
 		return false
 	}
-
-	sourceMap := make(map[string]struct{})
-	for item := range s.items {
-		sourceMap[item] = struct{}{}
-	}
-
-	targetMap := make(map[string]struct{})
-	for item := range target.items {
-		targetMap[item] = struct{}{}
-	}
-
-	for item := range target.items {
-		if _, exists := sourceMap[item]; !exists {
-			return false
-		}
-	}
-
-	return true
+	return s.containsAll(target)
 }
@@ -0,0 +1,261 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/poolpOrg/go-setdb"
+	"github.com/poolpOrg/go-setdb/sets"
+)
+
+type entry struct {
+	info    setdb.SetInfo
+	pattern string
+	items   []string
+	sketch  []byte
+	filter  []byte
+}
+
+// backend keeps sets in memory only, nothing survives Close(), which makes
+// it suitable for tests and short-lived sessions.
+type backend struct {
+	mu      sync.RWMutex
+	entries map[string]*entry
+	members map[string]map[string]struct{}
+	dbname  string
+}
+
+func init() {
+	setdb.Register("memory", newBackend)
+}
+
+func newBackend(name string) (setdb.Backend, error) {
+	return &backend{
+		entries: make(map[string]*entry),
+		members: make(map[string]map[string]struct{}),
+		dbname:  name,
+	}, nil
+}
+
+func (bck *backend) Close() error {
+	bck.mu.Lock()
+	defer bck.mu.Unlock()
+
+	bck.entries = make(map[string]*entry)
+	bck.members = make(map[string]map[string]struct{})
+	return nil
+}
+
+// index adds or removes the items of a set from the members index, it must
+// be called with the lock held.
+func (bck *backend) index(name string, items []string, add bool) {
+	for _, item := range items {
+		if add {
+			if _, exists := bck.members[item]; !exists {
+				bck.members[item] = make(map[string]struct{})
+			}
+			bck.members[item][name] = struct{}{}
+		} else {
+			delete(bck.members[item], name)
+			if len(bck.members[item]) == 0 {
+				delete(bck.members, item)
+			}
+		}
+	}
+}
+
+// copyInfo and copyBytes return what entries hold as copies, so that
+// callers can't modify the entries through them.
+func copyInfo(info setdb.SetInfo) setdb.SetInfo {
+	dependsOn := make([]string, len(info.DependsOn))
+	copy(dependsOn, info.DependsOn)
+	info.DependsOn = dependsOn
+	return info
+}
+
+func copyBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	ret := make([]byte, len(data))
+	copy(ret, data)
+	return ret
+}
+
+func (bck *backend) Info(name string) (setdb.SetInfo, error) {
+	bck.mu.RLock()
+	defer bck.mu.RUnlock()
+
+	e, exists := bck.entries[name]
+	if !exists {
+		return setdb.SetInfo{}, fmt.Errorf("%w: %s", setdb.ErrSetNotFound, name)
+	}
+	return copyInfo(e.info), nil
+}
+
+func (bck *backend) List() ([]setdb.SetInfo, error) {
+	bck.mu.RLock()
+	defer bck.mu.RUnlock()
+
+	resultSet := make([]setdb.SetInfo, 0, len(bck.entries))
+	for _, e := range bck.entries {
+		resultSet = append(resultSet, copyInfo(e.info))
+	}
+	sort.Slice(resultSet, func(i, j int) bool {
+		return resultSet[i].Name < resultSet[j].Name
+	})
+	return resultSet, nil
+}
+
+func (bck *backend) Persist(name string, pattern string, dependencies []string, items []string) error {
+	bck.mu.Lock()
+	defer bck.mu.Unlock()
+
+	dependsOn := make([]string, len(dependencies))
+	copy(dependsOn, dependencies)
+
+	setItems := make([]string, len(items))
+	copy(setItems, items)
+
+	sketch := sets.NewHyperLogLog()
+	filter := sets.NewBloomFilter(len(items))
+	for _, item := range items {
+		sketch.AddLiteral(item)
+		filter.AddLiteral(item)
+	}
+	serializedSketch, err := sketch.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	serializedFilter, err := filter.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if e, exists := bck.entries[name]; exists {
+		bck.index(name, e.items, false)
+		bck.index(name, setItems, true)
+		e.info.Mtime = now
+		e.info.DependsOn = dependsOn
+		e.pattern = pattern
+		e.items = setItems
+		e.sketch = serializedSketch
+		e.filter = serializedFilter
+		return nil
+	}
+	bck.index(name, setItems, true)
+
+	bck.entries[name] = &entry{
+		info: setdb.SetInfo{
+			Name:      name,
+			Uuid:      uuid.New(),
+			Ctime:     now,
+			Mtime:     now,
+			DependsOn: dependsOn,
+		},
+		pattern: pattern,
+		items:   setItems,
+		sketch:  serializedSketch,
+		filter:  serializedFilter,
+	}
+	return nil
+}
+
+func (bck *backend) MembershipOf(item string) ([]string, error) {
+	bck.mu.RLock()
+	defer bck.mu.RUnlock()
+
+	names := make([]string, 0, len(bck.members[item]))
+	for name := range bck.members[item] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (bck *backend) Pattern(name string) (string, error) {
+	bck.mu.RLock()
+	defer bck.mu.RUnlock()
+
+	e, exists := bck.entries[name]
+	if !exists {
+		return "", fmt.Errorf("%w: %s", setdb.ErrSetNotFound, name)
+	}
+	return e.pattern, nil
+}
+
+func (bck *backend) Sketch(name string) ([]byte, error) {
+	bck.mu.RLock()
+	defer bck.mu.RUnlock()
+
+	e, exists := bck.entries[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", setdb.ErrSetNotFound, name)
+	}
+	return copyBytes(e.sketch), nil
+}
+
+func (bck *backend) Filter(name string) ([]byte, error) {
+	bck.mu.RLock()
+	defer bck.mu.RUnlock()
+
+	e, exists := bck.entries[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", setdb.ErrSetNotFound, name)
+	}
+	return copyBytes(e.filter), nil
+}
+
+func (bck *backend) Delete(name string) error {
+	bck.mu.Lock()
+	defer bck.mu.Unlock()
+
+	e, exists := bck.entries[name]
+	if !exists {
+		return fmt.Errorf("%w: %s", setdb.ErrSetNotFound, name)
+	}
+	bck.index(name, e.items, false)
+	delete(bck.entries, name)
+	return nil
+}
+
+func (bck *backend) Rename(name string, newName string) error {
+	bck.mu.Lock()
+	defer bck.mu.Unlock()
+
+	e, exists := bck.entries[name]
+	if !exists {
+		return fmt.Errorf("%w: %s", setdb.ErrSetNotFound, name)
+	}
+	if _, exists := bck.entries[newName]; exists {
+		return fmt.Errorf("%w: %s", setdb.ErrSetExists, newName)
+	}
+
+	bck.index(name, e.items, false)
+	bck.index(newName, e.items, true)
+	e.info.Name = newName
+	e.info.Mtime = time.Now().UTC()
+	bck.entries[newName] = e
+	delete(bck.entries, name)
+	return nil
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/poolpOrg/go-setdb"
+	"github.com/poolpOrg/go-setdb/sets"
+)
+
+func open(t *testing.T) *backend {
+	t.Helper()
+	conn, err := newBackend(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.(*backend)
+}
+
+func persist(t *testing.T, bck *backend, name string, dependencies []string, items ...string) {
+	t.Helper()
+	if err := bck.Persist(name, fmt.Sprintf("pattern of %s", name), dependencies, items); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+}
+
+func members(t *testing.T, bck *backend, item string) string {
+	t.Helper()
+	names, err := bck.MembershipOf(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(names)
+}
+
+func TestPersist(t *testing.T) {
+	bck := open(t)
+	dependencies := []string{"a"}
+	items := []string{"2", "'x'"}
+	persist(t, bck, "a", nil, "1", "2")
+	persist(t, bck, "b", dependencies, items...)
+
+	// the entry doesn't share what it was persisted with
+	dependencies[0] = "z"
+	items[0] = "9"
+
+	info, err := bck.Info("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "b" || fmt.Sprint(info.DependsOn) != "[a]" || info.Ctime != info.Mtime {
+		t.Errorf("info %+v", info)
+	}
+	if pattern, err := bck.Pattern("b"); err != nil || pattern != "pattern of b" {
+		t.Errorf("pattern %q, %v", pattern, err)
+	}
+
+	tests := []struct {
+		item string
+		want string
+	}{
+		{"1", "[a]"},
+		{"2", "[a b]"},
+		{"'x'", "[b]"},
+		{"9", "[]"},
+		{"x", "[]"},
+	}
+	for _, test := range tests {
+		if got := members(t, bck, test.item); got != test.want {
+			t.Errorf("MembershipOf(%s) = %s, want %s", test.item, got, test.want)
+		}
+	}
+
+	// persisting again replaces the items and keeps the identity of the set
+	persist(t, bck, "a", []string{"c"}, "3")
+	updated, err := bck.Info("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(updated.DependsOn) != "[c]" || updated.Mtime.Before(updated.Ctime) {
+		t.Errorf("info %+v", updated)
+	}
+	if got := members(t, bck, "1"); got != "[]" {
+		t.Errorf("MembershipOf(1) = %s, want []", got)
+	}
+	if got := members(t, bck, "2"); got != "[b]" {
+		t.Errorf("MembershipOf(2) = %s, want [b]", got)
+	}
+	if got := members(t, bck, "3"); got != "[a]" {
+		t.Errorf("MembershipOf(3) = %s, want [a]", got)
+	}
+}
+
+func TestInfoCopies(t *testing.T) {
+	bck := open(t)
+	persist(t, bck, "a", []string{"b", "c"}, "1")
+
+	info, err := bck.Info("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Name = "z"
+	info.DependsOn[0] = "z"
+
+	list, err := bck.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	list[0].DependsOn[1] = "z"
+
+	sketch := mustSketch(t, bck, "a")
+	wantSketch := string(sketch)
+	sketch[0]++
+	filter, _ := bck.Filter("a")
+	wantFilter := string(filter)
+	filter[len(filter)-1]++
+
+	if info, _ := bck.Info("a"); info.Name != "a" || fmt.Sprint(info.DependsOn) != "[b c]" {
+		t.Errorf("info modified: %+v", info)
+	}
+	if string(mustSketch(t, bck, "a")) != wantSketch {
+		t.Errorf("sketch modified")
+	}
+	if filter, _ := bck.Filter("a"); string(filter) != wantFilter {
+		t.Errorf("filter modified")
+	}
+}
+
+func mustSketch(t *testing.T, bck *backend, name string) []byte {
+	t.Helper()
+	data, err := bck.Sketch(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func mustFilter(t *testing.T, bck *backend, name string) *sets.BloomFilter {
+	t.Helper()
+	data, err := bck.Filter(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &sets.BloomFilter{}
+	if err := f.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestSketchFilter(t *testing.T) {
+	bck := open(t)
+	items := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		items = append(items, fmt.Sprint(i))
+	}
+	persist(t, bck, "a", nil, items...)
+	persist(t, bck, "empty", nil)
+
+	sketch := sets.NewHyperLogLog()
+	if err := sketch.UnmarshalBinary(mustSketch(t, bck, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if count := sketch.Count(); count < 950 || count > 1050 {
+		t.Errorf("sketch estimates %.0f, want 1000", count)
+	}
+	f := mustFilter(t, bck, "a")
+	for _, item := range items {
+		if !f.MayContainLiteral(item) {
+			t.Fatalf("filter misses %s", item)
+		}
+	}
+	if mustFilter(t, bck, "empty").MayContainLiteral("1") {
+		t.Errorf("filter of an empty set holds 1")
+	}
+}
+
+func TestDeleteRename(t *testing.T) {
+	bck := open(t)
+	persist(t, bck, "a", nil, "1", "2")
+	persist(t, bck, "b", []string{"a"}, "2")
+	before, _ := bck.Info("a")
+
+	if err := bck.Rename("a", "b"); !errors.Is(err, setdb.ErrSetExists) {
+		t.Errorf("Rename(a, b): got %v, want %v", err, setdb.ErrSetExists)
+	}
+	if err := bck.Rename("nope", "c"); !errors.Is(err, setdb.ErrSetNotFound) {
+		t.Errorf("Rename(nope, c): got %v, want %v", err, setdb.ErrSetNotFound)
+	}
+	if err := bck.Rename("a", "c"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := bck.Info("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Name != "c" || after.Uuid != before.Uuid || after.Ctime != before.Ctime {
+		t.Errorf("renamed info %+v, was %+v", after, before)
+	}
+	if got := members(t, bck, "2"); got != "[b c]" {
+		t.Errorf("MembershipOf(2) = %s, want [b c]", got)
+	}
+	if pattern, _ := bck.Pattern("c"); pattern != "pattern of a" {
+		t.Errorf("pattern %q, want %q", pattern, "pattern of a")
+	}
+
+	if err := bck.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bck.Delete("c"); !errors.Is(err, setdb.ErrSetNotFound) {
+		t.Errorf("Delete(c): got %v, want %v", err, setdb.ErrSetNotFound)
+	}
+	if got := members(t, bck, "1"); got != "[]" {
+		t.Errorf("MembershipOf(1) = %s, want []", got)
+	}
+	if got := members(t, bck, "2"); got != "[b]" {
+		t.Errorf("MembershipOf(2) = %s, want [b]", got)
+	}
+	if list, _ := bck.List(); len(list) != 1 || list[0].Name != "b" {
+		t.Errorf("List() = %+v, want b only", list)
+	}
+
+	for _, name := range []string{"a", "c"} {
+		if _, err := bck.Info(name); !errors.Is(err, setdb.ErrSetNotFound) {
+			t.Errorf("Info(%s): got %v, want %v", name, err, setdb.ErrSetNotFound)
+		}
+		if _, err := bck.Pattern(name); !errors.Is(err, setdb.ErrSetNotFound) {
+			t.Errorf("Pattern(%s): got %v, want %v", name, err, setdb.ErrSetNotFound)
+		}
+		if _, err := bck.Sketch(name); !errors.Is(err, setdb.ErrSetNotFound) {
+			t.Errorf("Sketch(%s): got %v, want %v", name, err, setdb.ErrSetNotFound)
+		}
+		if _, err := bck.Filter(name); !errors.Is(err, setdb.ErrSetNotFound) {
+			t.Errorf("Filter(%s): got %v, want %v", name, err, setdb.ErrSetNotFound)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sqlite
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultDir = "/tmp"
+
+var journalModes = map[string]struct{}{
+	"delete":   {},
+	"truncate": {},
+	"persist":  {},
+	"memory":   {},
+	"wal":      {},
+	"off":      {},
+}
+
+var synchronousLevels = map[string]struct{}{
+	"off":    {},
+	"normal": {},
+	"full":   {},
+	"extra":  {},
+}
+
+// Options describes where a database lives and how the connection to it is
+// set up. They are usually obtained from the name passed to setdb.Open:
+//
+//	name[?option=value&...]
+//	[file:]path/to/file.db[?option=value&...]
+//
+// A bare name is stored as <dir>/<name>.db, dir defaulting to /tmp, while
+// anything containing a / is used as the path of the database file. The
+// supported options are dir, journal_mode, busy_timeout (milliseconds),
+// synchronous and mode (ro or rw).
+type Options struct {
+	Name        string
+	Dir         string
+	Path        string
+	JournalMode string
+	BusyTimeout time.Duration
+	Synchronous string
+	ReadOnly    bool
+}
+
+func ParseDSN(dsn string) (Options, error) {
+	options := Options{}
+
+	location, query, _ := strings.Cut(dsn, "?")
+	location = strings.TrimPrefix(location, "file:")
+	if location == "" {
+		return Options{}, fmt.Errorf("missing database name")
+	}
+	if strings.Contains(location, "/") {
+		options.Path = location
+		options.Name = strings.TrimSuffix(filepath.Base(location), filepath.Ext(location))
+	} else {
+		options.Name = location
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return Options{}, err
+	}
+	for key := range values {
+		value := values.Get(key)
+		switch key {
+		case "dir":
+			if options.Path != "" {
+				return Options{}, fmt.Errorf("dir can't be combined with a path")
+			}
+			options.Dir = value
+
+		case "journal_mode":
+			value = strings.ToLower(value)
+			if _, exists := journalModes[value]; !exists {
+				return Options{}, fmt.Errorf("invalid journal_mode: %s", value)
+			}
+			options.JournalMode = value
+
+		case "busy_timeout":
+			timeout, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return Options{}, fmt.Errorf("invalid busy_timeout: %s", value)
+			}
+			options.BusyTimeout = time.Duration(timeout) * time.Millisecond
+
+		case "synchronous":
+			value = strings.ToLower(value)
+			if _, exists := synchronousLevels[value]; !exists {
+				return Options{}, fmt.Errorf("invalid synchronous: %s", value)
+			}
+			options.Synchronous = value
+
+		case "mode":
+			switch value {
+			case "ro":
+				options.ReadOnly = true
+			case "rw":
+				options.ReadOnly = false
+			default:
+				return Options{}, fmt.Errorf("invalid mode: %s", value)
+			}
+
+		default:
+			return Options{}, fmt.Errorf("unknown option: %s", key)
+		}
+	}
+
+	return options, nil
+}
+
+// DSN returns the name to pass to setdb.Open for these options.
+func (o Options) DSN() string {
+	location := o.Name
+	if o.Path != "" {
+		location = o.Path
+	}
+
+	values := url.Values{}
+	if o.Dir != "" && o.Path == "" {
+		values.Set("dir", o.Dir)
+	}
+	if o.JournalMode != "" {
+		values.Set("journal_mode", o.JournalMode)
+	}
+	if o.BusyTimeout != 0 {
+		values.Set("busy_timeout", strconv.FormatInt(o.BusyTimeout.Milliseconds(), 10))
+	}
+	if o.Synchronous != "" {
+		values.Set("synchronous", o.Synchronous)
+	}
+	if o.ReadOnly {
+		values.Set("mode", "ro")
+	}
+
+	if len(values) == 0 {
+		return location
+	}
+	return location + "?" + values.Encode()
+}
+
+func (o Options) filename() string {
+	if o.Path != "" {
+		return o.Path
+	}
+	dir := o.Dir
+	if dir == "" {
+		dir = defaultDir
+	}
+	return filepath.Join(dir, o.Name+".db")
+}
+
+// driverDSN returns the DSN understood by the go-sqlite3 driver.
+func (o Options) driverDSN() string {
+	values := url.Values{}
+	if o.JournalMode != "" {
+		values.Set("_journal_mode", strings.ToUpper(o.JournalMode))
+	}
+	if o.BusyTimeout != 0 {
+		values.Set("_busy_timeout", strconv.FormatInt(o.BusyTimeout.Milliseconds(), 10))
+	}
+	if o.Synchronous != "" {
+		values.Set("_synchronous", strings.ToUpper(o.Synchronous))
+	}
+	if o.ReadOnly {
+		values.Set("mode", "ro")
+	}
+
+	if len(values) == 0 {
+		return o.filename()
+	}
+	return "file:" + o.filename() + "?" + values.Encode()
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package sqlite
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDSN(t *testing.T) {
+	tests := []struct {
+		dsn      string
+		options  Options
+		filename string
+		driver   string
+	}{
+		{
+			dsn:      "test",
+			options:  Options{Name: "test"},
+			filename: "/tmp/test.db",
+			driver:   "/tmp/test.db",
+		},
+		{
+			dsn:      "test?dir=/var/db",
+			options:  Options{Name: "test", Dir: "/var/db"},
+			filename: "/var/db/test.db",
+			driver:   "/var/db/test.db",
+		},
+		{
+			dsn:      "file:/var/db/test.sqlite",
+			options:  Options{Name: "test", Path: "/var/db/test.sqlite"},
+			filename: "/var/db/test.sqlite",
+			driver:   "/var/db/test.sqlite",
+		},
+		{
+			dsn:      "./test.db?mode=ro",
+			options:  Options{Name: "test", Path: "./test.db", ReadOnly: true},
+			filename: "./test.db",
+			driver:   "file:./test.db?mode=ro",
+		},
+		{
+			dsn: "test?journal_mode=WAL&busy_timeout=500&synchronous=Normal&mode=rw",
+			options: Options{
+				Name:        "test",
+				JournalMode: "wal",
+				BusyTimeout: 500 * time.Millisecond,
+				Synchronous: "normal",
+			},
+			filename: "/tmp/test.db",
+			driver:   "file:/tmp/test.db?_busy_timeout=500&_journal_mode=WAL&_synchronous=NORMAL",
+		},
+	}
+
+	for _, test := range tests {
+		options, err := ParseDSN(test.dsn)
+		if err != nil {
+			t.Errorf("ParseDSN(%q): %v", test.dsn, err)
+			continue
+		}
+		if options != test.options {
+			t.Errorf("ParseDSN(%q) = %+v, want %+v", test.dsn, options, test.options)
+		}
+		if filename := options.filename(); filename != test.filename {
+			t.Errorf("ParseDSN(%q).filename() = %q, want %q", test.dsn, filename, test.filename)
+		}
+		if driver := options.driverDSN(); driver != test.driver {
+			t.Errorf("ParseDSN(%q).driverDSN() = %q, want %q", test.dsn, driver, test.driver)
+		}
+
+		// DSN must yield back the same options
+		reparsed, err := ParseDSN(options.DSN())
+		if err != nil {
+			t.Errorf("ParseDSN(%q): %v", options.DSN(), err)
+		} else if reparsed != options {
+			t.Errorf("ParseDSN(%q) = %+v, want %+v", options.DSN(), reparsed, options)
+		}
+	}
+}
+
+func TestParseDSNInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"file:",
+		"?dir=/tmp",
+		"/var/db/test.db?dir=/tmp",
+		"test?journal_mode=fast",
+		"test?busy_timeout=-1",
+		"test?busy_timeout=1s",
+		"test?synchronous=always",
+		"test?mode=rwc",
+		"test?cache=shared",
+		"test?dir=%zz",
+	}
+
+	for _, dsn := range tests {
+		if options, err := ParseDSN(dsn); err == nil {
+			t.Errorf("ParseDSN(%q) = %+v, want error", dsn, options)
+		}
+	}
+}
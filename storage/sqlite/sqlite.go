@@ -25,6 +25,7 @@ import (
 	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/poolpOrg/go-setdb"
+	"github.com/poolpOrg/go-setdb/sets"
 )
 
 type backend struct {
@@ -36,10 +37,28 @@ func init() {
 	setdb.Register("sqlite", newBackend)
 }
 
-func newBackend(name string) setdb.Backend {
-	conn, err := sql.Open("sqlite3", "/tmp/"+name+".db")
+func newBackend(name string) (setdb.Backend, error) {
+	options, err := ParseDSN(name)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	conn, err := sql.Open("sqlite3", options.driverDSN())
+	if err != nil {
+		return nil, err
+	}
+
+	// sql.Open defers connecting, make sure the database is reachable
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if options.ReadOnly {
+		return &backend{
+			conn:   conn,
+			dbname: options.Name,
+		}, nil
 	}
 
 	const createTableSets string = `
@@ -55,13 +74,58 @@ func newBackend(name string) setdb.Backend {
 			`
 	_, err = conn.Exec(createTableSets)
 	if err != nil {
-		panic(err)
+		conn.Close()
+		return nil, err
+	}
+
+	// members indexes the items of each set so that the sets containing an
+	// item can be looked up without evaluating them
+	const createTableMembers string = `
+			CREATE TABLE IF NOT EXISTS members (
+				item TEXT NOT NULL,
+				setname char(255) NOT NULL,
+				PRIMARY KEY (item, setname)
+			);
+			CREATE INDEX IF NOT EXISTS members_setname ON members (setname);
+			`
+	_, err = conn.Exec(createTableMembers)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// sketches holds a HyperLogLog of the items of each set, estimating
+	// cardinalities without evaluating them
+	const createTableSketches string = `
+			CREATE TABLE IF NOT EXISTS sketches (
+				setname char(255) NOT NULL PRIMARY KEY,
+				sketch BLOB NOT NULL
+			);
+			`
+	_, err = conn.Exec(createTableSketches)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// filters holds a Bloom filter of the items of each set, telling that
+	// an item isn't part of a set without evaluating it
+	const createTableFilters string = `
+			CREATE TABLE IF NOT EXISTS filters (
+				setname char(255) NOT NULL PRIMARY KEY,
+				filter BLOB NOT NULL
+			);
+			`
+	_, err = conn.Exec(createTableFilters)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
 
 	return &backend{
 		conn:   conn,
-		dbname: name,
-	}
+		dbname: options.Name,
+	}, nil
 }
 
 func (bck *backend) Close() error {
@@ -110,8 +174,11 @@ func (bck *backend) Info(name string) (setdb.SetInfo, error) {
 			DependsOn: dependsOn,
 		}, nil
 	}
+	if err := res.Err(); err != nil {
+		return setdb.SetInfo{}, err
+	}
 
-	return setdb.SetInfo{}, err
+	return setdb.SetInfo{}, fmt.Errorf("%w: %s", setdb.ErrSetNotFound, name)
 }
 
 func (bck *backend) List() ([]setdb.SetInfo, error) {
@@ -156,21 +223,113 @@ func (bck *backend) List() ([]setdb.SetInfo, error) {
 	return resultSet, nil
 }
 
-func (bck *backend) Persist(name string, pattern string, dependencies []string) error {
-	stmt, err := bck.conn.Prepare(`INSERT OR REPLACE INTO sets (mtime, name, pattern, dependsOn) VALUES(CURRENT_TIMESTAMP, ?, ?, ?)`)
+func (bck *backend) Persist(name string, pattern string, dependencies []string, items []string) error {
+	deps, err := json.Marshal(dependencies)
+	if err != nil {
+		return err
+	}
+
+	tx, err := bck.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO sets (mtime, name, pattern, dependsOn) VALUES(CURRENT_TIMESTAMP, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET mtime=excluded.mtime, pattern=excluded.pattern, dependsOn=excluded.dependsOn`,
+		name, pattern, deps)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM members WHERE setname=?`, name)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO members (item, setname) VALUES(?, ?)`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	deps, err := json.Marshal(dependencies)
+	sketch := sets.NewHyperLogLog()
+	filter := sets.NewBloomFilter(len(items))
+	for _, item := range items {
+		if _, err := stmt.Exec(item, name); err != nil {
+			return err
+		}
+		sketch.AddLiteral(item)
+		filter.AddLiteral(item)
+	}
+
+	serializedSketch, err := sketch.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO sketches (setname, sketch) VALUES(?, ?)
+		ON CONFLICT(setname) DO UPDATE SET sketch=excluded.sketch`,
+		name, serializedSketch)
 	if err != nil {
 		return err
 	}
 
-	_, err = stmt.Exec(name, pattern, deps)
+	serializedFilter, err := filter.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO filters (setname, filter) VALUES(?, ?)
+		ON CONFLICT(setname) DO UPDATE SET filter=excluded.filter`,
+		name, serializedFilter)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return tx.Commit()
+}
+
+func (bck *backend) MembershipOf(item string) ([]string, error) {
+	res, err := bck.conn.Query(`SELECT setname FROM members WHERE item=? ORDER BY setname`, item)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	names := make([]string, 0)
+	for res.Next() {
+		var name string
+		if err := res.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, res.Err()
+}
+
+func (bck *backend) Sketch(name string) ([]byte, error) {
+	if _, err := bck.Pattern(name); err != nil {
+		return nil, err
+	}
+
+	var sketch []byte
+	err := bck.conn.QueryRow(`SELECT sketch FROM sketches WHERE setname=?`, name).Scan(&sketch)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return sketch, err
+}
+
+func (bck *backend) Filter(name string) ([]byte, error) {
+	if _, err := bck.Pattern(name); err != nil {
+		return nil, err
+	}
+
+	var filter []byte
+	err := bck.conn.QueryRow(`SELECT filter FROM filters WHERE setname=?`, name).Scan(&filter)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return filter, err
 }
 
 func (bck *backend) Pattern(name string) (string, error) {
@@ -187,7 +346,7 @@ func (bck *backend) Pattern(name string) (string, error) {
 	defer res.Close()
 
 	if !res.Next() {
-		return "", fmt.Errorf("set %s does not exist", name)
+		return "", fmt.Errorf("%w: %s", setdb.ErrSetNotFound, name)
 	}
 	var template string
 	err = res.Scan(&template)
@@ -197,3 +356,77 @@ func (bck *backend) Pattern(name string) (string, error) {
 
 	return template, nil
 }
+
+func (bck *backend) Delete(name string) error {
+	tx, err := bck.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM sets WHERE name=?`, name)
+	if err != nil {
+		return err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("%w: %s", setdb.ErrSetNotFound, name)
+	}
+
+	_, err = tx.Exec(`DELETE FROM members WHERE setname=?`, name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM sketches WHERE setname=?`, name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM filters WHERE setname=?`, name)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (bck *backend) Rename(name string, newName string) error {
+	if _, err := bck.Pattern(newName); err == nil {
+		return fmt.Errorf("%w: %s", setdb.ErrSetExists, newName)
+	}
+
+	tx, err := bck.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE sets SET mtime=CURRENT_TIMESTAMP, name=? WHERE name=?`, newName, name)
+	if err != nil {
+		return err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("%w: %s", setdb.ErrSetNotFound, name)
+	}
+
+	_, err = tx.Exec(`UPDATE members SET setname=? WHERE setname=?`, newName, name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE sketches SET setname=? WHERE setname=?`, newName, name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE filters SET setname=? WHERE setname=?`, newName, name)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package setdb
+
+import (
+	"github.com/poolpOrg/go-setdb/query/ast"
+	"github.com/poolpOrg/go-setdb/sets"
+)
+
+// transaction stages the changes of a write along with the re-evaluation
+// of every set depending on the sets it changes. Staged sets are resolved
+// from the transaction rather than from the backend, so every affected set
+// is evaluated against the new content before anything is persisted, and a
+// set failing to evaluate aborts the write with the database left as is.
+type transaction struct {
+	db *Database
+
+	// staged holds the content of the sets changed so far, nil for the
+	// deleted ones
+	staged map[string]*cacheEntry
+
+	// changes are applied in order on commit
+	changes []func() error
+}
+
+func (db *Database) begin() *transaction {
+	return &transaction{
+		db:      db,
+		staged:  make(map[string]*cacheEntry),
+		changes: make([]func() error, 0),
+	}
+}
+
+func (tx *transaction) newResolver(name string) *resolver {
+	r := tx.db.newResolver(name)
+	r.staged = tx.staged
+	return r
+}
+
+// put stages the content of a set to be persisted.
+func (tx *transaction) put(name string, pattern string, dependencies []string, items *sets.Set) {
+	tx.staged[name] = &cacheEntry{name: name, items: items, dependencies: dependencies}
+	tx.changes = append(tx.changes, func() error {
+		return tx.db.store(name, pattern, dependencies, items)
+	})
+}
+
+// delete stages the deletion of a set.
+func (tx *transaction) delete(name string) {
+	tx.staged[name] = nil
+	tx.changes = append(tx.changes, func() error {
+		tx.db.invalidate(name)
+		return tx.db.backend.Delete(name)
+	})
+}
+
+// rename stages the renaming of a set, which keeps the content it has.
+func (tx *transaction) rename(name string, newName string) error {
+	resolvedSet, err := tx.newResolver("").resolve(name)
+	if err != nil {
+		return err
+	}
+	info, err := tx.db.backend.Info(name)
+	if err != nil {
+		return err
+	}
+
+	tx.staged[name] = nil
+	tx.staged[newName] = &cacheEntry{name: newName, items: resolvedSet.Items, dependencies: info.DependsOn}
+	tx.changes = append(tx.changes, func() error {
+		if err := tx.db.backend.Rename(name, newName); err != nil {
+			return err
+		}
+		tx.db.invalidate(name)
+		tx.db.invalidate(newName)
+		return nil
+	})
+	return nil
+}
+
+// evaluate evaluates the pattern of a set against the staged sets and
+// stages its content.
+func (tx *transaction) evaluate(name string, pattern ast.Node) error {
+	r := tx.newResolver(name)
+	dependencies, err := r.require(ast.References(pattern))
+	if err != nil {
+		return err
+	}
+	items, err := r.optimize(pattern).Evaluate(r.resolve)
+	if err != nil {
+		return err
+	}
+	tx.put(name, pattern.ToQuery(), dependencies, items)
+	return nil
+}
+
+// refresh re-evaluates the sets whose content depends on name and that are
+// not staged yet. Sets referencing a wildcard matching name are refreshed as
+// well, name may have just been created.
+func (tx *transaction) refresh(name string) error {
+	dependents, err := tx.db.affected(name)
+	if err != nil {
+		return err
+	}
+	for _, dependent := range dependents {
+		if _, exists := tx.staged[dependent.Name]; exists {
+			continue
+		}
+		pattern, err := tx.db.pattern(dependent.Name)
+		if err != nil {
+			return err
+		}
+		if err := tx.evaluate(dependent.Name, pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *transaction) commit() error {
+	for _, change := range tx.changes {
+		if err := change(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
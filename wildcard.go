@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2023 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package setdb
+
+import (
+	"path"
+	"sort"
+
+	"github.com/poolpOrg/go-setdb/query/ast"
+)
+
+// expand returns the persisted sets matching a wildcard, ordered by name.
+// The excluded sets are left out along with the sets depending on them, as
+// they would otherwise end up referencing themselves through the wildcard.
+func (db *Database) expand(wildcard string, excluded []string) ([]SetInfo, error) {
+	setsInfo, err := db.backend.List()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]SetInfo, 0)
+	for _, setInfo := range setsInfo {
+		if matchWildcard(wildcard, setInfo.Name) && !excludes(excluded, setInfo) {
+			ret = append(ret, setInfo)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
+
+// excludes returns true if a set is one of the excluded sets or depends on
+// one of them.
+func excludes(excluded []string, setInfo SetInfo) bool {
+	if containsName(excluded, setInfo.Name) {
+		return true
+	}
+	for _, name := range excluded {
+		if name != "" && covers(setInfo.DependsOn, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchWildcard(wildcard string, name string) bool {
+	matched, err := path.Match(wildcard, name)
+	return err == nil && matched
+}
+
+// covers returns true if dependencies, which may hold wildcards, include
+// name.
+func covers(dependencies []string, name string) bool {
+	for _, dependency := range dependencies {
+		if dependency == name {
+			return true
+		}
+		if ast.IsWildcard(dependency) && matchWildcard(dependency, name) {
+			return true
+		}
+	}
+	return false
+}